@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+const (
+	// labelPlugin marks the containers this plugin creates, its value is the
+	// keyPrefix, so plugins keeping their volumes apart don't touch each other's
+	labelPlugin = "com.seaweedfs.plugin"
+	// labelVolume is the name of the volume a mount helper container is for
+	labelVolume = "com.seaweedfs.plugin.volume"
+	// labelConfig is the configHash of the configuration a container was created from
+	labelConfig = "com.seaweedfs.plugin.config"
+)
+
+// helperRunner starts and stops the mount helpers of the volumes on this node
+type helperRunner interface {
+	// mount starts the volume's helper, returning once the volume is mounted
+	mount(v *seaweedfsVolume) error
+	// unmount unmounts the volume and stops its helper
+	unmount(v *seaweedfsVolume) error
+	// remove removes the named volume's helpers
+	remove(name string) error
+}
+
+// dockerHelpers runs the mount helpers as Docker containers
+type dockerHelpers struct{}
+
+func (dockerHelpers) mount(v *seaweedfsVolume) error   { return mountVolume(v) }
+func (dockerHelpers) unmount(v *seaweedfsVolume) error { return unmountVolume(v) }
+func (dockerHelpers) remove(name string) error         { return removeHelpers(name) }
+
+// configHash hashes a container's configuration, to tell whether an existing
+// container was created from the same one.
+func configHash(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig) (string, error) {
+	data, err := json.Marshal([]interface{}{config, hostConfig, networkingConfig})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// pluginLabels are the labels of a container the plugin creates, for the named
+// volume or, if volumeName is empty, for no volume at all.
+func pluginLabels(volumeName string) map[string]string {
+	labels := map[string]string{labelPlugin: keyPrefix}
+	if volumeName != "" {
+		labels[labelVolume] = volumeName
+	}
+	return labels
+}
+
+// listPluginContainers returns this plugin's containers on this node, running
+// or not, narrowed down by any extra filters.
+func listPluginContainers(ctx context.Context, extra ...filters.KeyValuePair) ([]types.Container, error) {
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	args := filters.NewArgs(append(extra, filters.Arg("label", labelPlugin+"="+keyPrefix))...)
+	return cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+}
+
+// removeContainer force removes a container, running or not.
+func removeContainer(ctx context.Context, id string) error {
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return err
+	}
+	return cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+}
+
+// stopAndRemoveContainer removes a container after giving it the chance to
+// stop, so that weed mount unmounts cleanly.
+func stopAndRemoveContainer(ctx context.Context, id string) error {
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return err
+	}
+	timeout := 10 * time.Second
+	if err := cli.ContainerStop(ctx, id, &timeout); err != nil && !client.IsErrNotFound(err) {
+		logrus.Warnf("stopping container %s: %s", id, err)
+	}
+	return removeContainer(ctx, id)
+}
+
+// removeHelpers removes the named volume's mount helper containers on this node.
+func removeHelpers(name string) error {
+	ctx := context.Background()
+	containers, err := listPluginContainers(ctx, filters.Arg("label", labelVolume+"="+name))
+	if err != nil {
+		return fmt.Errorf("listing the helper containers of volume %s: %s", name, err)
+	}
+	for _, c := range containers {
+		logrus.Debugf("removing helper container %s of volume %s", c.ID, name)
+		if err := removeContainer(ctx, c.ID); err != nil {
+			return fmt.Errorf("removing helper container %s of volume %s: %s", c.ID, name, err)
+		}
+	}
+	return nil
+}
+
+// collectContainers removes the plugin's containers on this node that are left
+// over: mount helpers of volumes that no longer exist, and stopped containers
+// not belonging to any volume, that were created before the plugin started.
+// Volumes the store can't tell about are kept.
+func (d *seaweedfsDriver) collectContainers() error {
+	ctx := context.Background()
+	containers, err := listPluginContainers(ctx)
+	if err != nil {
+		return fmt.Errorf("listing plugin containers: %s", err)
+	}
+
+	removed := 0
+	for _, c := range containers {
+		if name := c.Labels[labelVolume]; name != "" {
+			gone, err := d.collectHelper(ctx, c, name)
+			if err != nil {
+				logrus.Warnf("keeping helper container %s of volume %s: %s", c.ID, name, err)
+			}
+			if gone {
+				removed++
+			}
+			continue
+		}
+
+		// a container created since may be one a request is about to start
+		if c.State == "running" || !time.Unix(c.Created, 0).Before(d.started) {
+			continue
+		}
+		logrus.Infof("removing left over container %s %v", c.ID, c.Names)
+		if err := removeContainer(ctx, c.ID); err != nil {
+			logrus.Errorf("removing left over container %s: %s", c.ID, err)
+			continue
+		}
+		removed++
+	}
+	if removed != 0 {
+		logrus.Infof("removed %d left over containers", removed)
+	}
+	return nil
+}
+
+// collectHelper removes the named volume's helper container c if the volume no
+// longer exists, unmounting it first if it is running, so that no dead mount
+// is left behind. It tells whether c was removed.
+func (d *seaweedfsDriver) collectHelper(ctx context.Context, c types.Container, name string) (bool, error) {
+	unlock, err := d.lockVolume(name)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if _, err := d.getVolumeInfo(name); err != store.ErrKeyNotFound {
+		return false, err
+	}
+	logrus.Infof("removing helper container %s %v, its volume %s no longer exists", c.ID, c.Names, name)
+	if c.State == "running" {
+		v := seaweedfsVolume{Name: name, Mountpoint: filepath.Join("/mnt/docker-volumes", name)}
+		if err := d.helpers.unmount(&v); err != nil {
+			return false, err
+		}
+	}
+	if err := removeContainer(ctx, c.ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// helperOutdated tells whether a helper container, labeled with labels, was
+// created from a different configuration than the volume would be mounted
+// with now.
+func helperOutdated(labels map[string]string, v *seaweedfsVolume) (bool, error) {
+	config, hostConfig, networkingConfig, err := helperConfig(v)
+	if err != nil {
+		return false, err
+	}
+	hash, err := configHash(config, hostConfig, networkingConfig)
+	if err != nil {
+		return false, err
+	}
+	return labels[labelConfig] != hash, nil
+}
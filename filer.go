@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// filerHosts are the SeaweedFS filers new volumes are mounted from, set
+// with HOST as a comma separated list of host:port
+var filerHosts = splitList(envOr("HOST", "filer:8888"))
+
+// filerListing is the part of the filer's JSON directory listing we look at
+type filerListing struct {
+	Path string
+}
+
+// filerCheckTimeout bounds checkFilerDir, including pulling the helper image
+const filerCheckTimeout = 2 * time.Minute
+
+// checkFilerScript looks directory $1 up on the filers given after it, with
+// the busybox wget of the helper image, and prints the JSON listing of the
+// first filer that answers. It exits 2 if that filer doesn't have the
+// directory, and 1 if no filer answers.
+const checkFilerScript = `dir=$1; shift
+for filer; do
+	if out=$(wget -q -T 3 -O - --header 'Accept: application/json' "http://$filer$dir/?limit=1" 2>&1); then
+		echo "$out"; exit 0
+	fi
+	case $out in *" 404"*) echo "$dir does not exist on filer $filer" >&2; exit 2;; esac
+	echo "filer $filer: $out" >&2
+done
+exit 1`
+
+// checkFilerDir checks, through the filer's HTTP API, that the volume's remote
+// path exists and is a directory. It asks from a container on the volume's
+// network, like its mount helper would, as the filers' names may only resolve there.
+func checkFilerDir(v *seaweedfsVolume) error {
+	if len(v.Filers) == 0 {
+		return fmt.Errorf("no filer configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), filerCheckTimeout)
+	defer cancel()
+
+	dir := strings.TrimSuffix(v.RemotePath, "/")
+	cmd := append([]string{"sh", "-c", checkFilerScript, "sh", dir}, v.Filers...)
+	status, stdout, stderr, err := runOnce(ctx, v.image(), v.Network, cmd)
+	if err != nil {
+		return fmt.Errorf("checking %s on the filer: %s", v.RemotePath, err)
+	}
+	switch status {
+	case 0:
+	case 2:
+		return errors.New(strings.TrimSpace(stderr))
+	default:
+		return fmt.Errorf("no filer reachable on network %s: %s", v.Network, strings.TrimSpace(stderr))
+	}
+
+	var listing filerListing
+	if err := json.Unmarshal([]byte(stdout), &listing); err != nil || listing.Path == "" {
+		return fmt.Errorf("%s is not a directory on the filer", v.RemotePath)
+	}
+	return nil
+}
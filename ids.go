@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The uid and gid volume options may name a user or group. The plugin's own
+// /etc/passwd has nothing to do with the containers using the volume, so names
+// are resolved against these files instead, in passwd(5) and group(5) format.
+var (
+	passwdFile = envOr("PASSWD_FILE", filepath.Join(stateDir, "passwd"))
+	groupFile  = envOr("GROUP_FILE", filepath.Join(stateDir, "group"))
+)
+
+// idEntry is a passwd or group entry: a name, its ID and (for users) primary group
+type idEntry struct {
+	name    string
+	id, gid int
+}
+
+// readIDFile reads a passwd(5) or group(5) format file.
+func readIDFile(file string) ([]idEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []idEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		entry := idEntry{name: fields[0], gid: -1}
+		if entry.id, err = strconv.Atoi(fields[2]); err != nil {
+			continue
+		}
+		if len(fields) > 3 {
+			if gid, err := strconv.Atoi(fields[3]); err == nil {
+				entry.gid = gid
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// lookupID finds a user or group entry by name, or by ID if val is numeric.
+// Numeric IDs don't need an entry, or the file at all.
+func lookupID(file, what, val string) (idEntry, error) {
+	id, numErr := strconv.Atoi(val)
+	entries, err := readIDFile(file)
+	if err != nil && !(numErr == nil && os.IsNotExist(err)) {
+		return idEntry{}, fmt.Errorf("cannot resolve %s %q: %s", what, val, err)
+	}
+	for _, e := range entries {
+		if (numErr == nil && e.id == id) || (numErr != nil && e.name == val) {
+			return e, nil
+		}
+	}
+	if numErr == nil {
+		return idEntry{name: val, id: id, gid: -1}, nil
+	}
+	return idEntry{}, fmt.Errorf("%s %q not found in %s", what, val, file)
+}
+
+// resolveIDs turns the uid and gid volume options into numeric IDs. The user
+// can also be given as user:group. Without a group, the user's primary group
+// from the passwd file is used, or 0 if the user has no entry there.
+func resolveIDs(userOpt, groupOpt string) (uid, gid int, err error) {
+	if parts := strings.SplitN(userOpt, ":", 2); len(parts) == 2 {
+		if groupOpt != "" && groupOpt != parts[1] {
+			return 0, 0, fmt.Errorf("uid=%s and gid=%s name different groups", userOpt, groupOpt)
+		}
+		userOpt, groupOpt = parts[0], parts[1]
+	}
+
+	gid = -1
+	if userOpt != "" {
+		u, err := lookupID(passwdFile, "user", userOpt)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, gid = u.id, u.gid
+	}
+	if groupOpt != "" {
+		g, err := lookupID(groupFile, "group", groupOpt)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid = g.id
+	}
+	if gid < 0 {
+		gid = 0
+	}
+	return uid, gid, nil
+}
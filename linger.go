@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// lingerTime is how long a volume stays mounted on a node after the last
+// container there unmounted it, set with LINGER
+var lingerTime time.Duration
+
+func checkLinger() (err error) {
+	val := envOr("LINGER", "60s")
+	if lingerTime, err = parseDuration(val); err != nil || lingerTime < 0 {
+		return fmt.Errorf("unsupported LINGER %q, use a duration like 90s or 5m, or 0 to unmount straight away", val)
+	}
+	return nil
+}
+
+// linger returns how long the volume lingers, its linger option overrides LINGER.
+func (v *seaweedfsVolume) linger() time.Duration {
+	if val, ok := optionValue(v.Options, "linger"); ok {
+		if linger, err := parseDuration(val); err == nil {
+			return linger
+		}
+	}
+	return lingerTime
+}
+
+// scheduleUnmount unmounts the volume once it has lingered, unless a Mount
+// cancels it first. The caller holds the volume lock.
+func (d *seaweedfsDriver) scheduleUnmount(v *seaweedfsVolume) error {
+	linger := v.linger()
+	if linger == 0 {
+		return d.helpers.unmount(v)
+	}
+
+	name := v.Name
+	d.lingersLock.Lock()
+	defer d.lingersLock.Unlock()
+	if d.lingers == nil {
+		d.lingers = map[string]*time.Timer{}
+	}
+	if t, ok := d.lingers[name]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(linger, func() { d.lingerExpired(name, t) })
+	d.lingers[name] = t
+	logrus.Debugf("unmounting volume %s in %s", name, linger)
+	return nil
+}
+
+// cancelUnmount stops the pending unmount of the named volume, if there is one.
+func (d *seaweedfsDriver) cancelUnmount(name string) {
+	d.lingersLock.Lock()
+	defer d.lingersLock.Unlock()
+	if t, ok := d.lingers[name]; ok {
+		t.Stop()
+		delete(d.lingers, name)
+		logrus.Debugf("cancelled unmounting volume %s", name)
+	}
+}
+
+// lingerExpired unmounts the named volume, unless t is no longer its pending
+// unmount or the volume got mounted on this node again in the meantime.
+func (d *seaweedfsDriver) lingerExpired(name string, t *time.Timer) {
+	unlock, err := d.lockVolume(name)
+	if err != nil {
+		logrus.Errorf("unmounting volume %s: %s, trying again in %s", name, err, lockTimeout)
+		d.lingersLock.Lock()
+		if d.lingers[name] == t {
+			t.Reset(lockTimeout)
+		}
+		d.lingersLock.Unlock()
+		return
+	}
+	defer unlock()
+
+	d.lingersLock.Lock()
+	current := d.lingers[name] == t
+	if current {
+		delete(d.lingers, name)
+	}
+	d.lingersLock.Unlock()
+	if !current {
+		return
+	}
+
+	v, err := d.getVolumeInfo(name)
+	if err == store.ErrKeyNotFound {
+		// removed on another node meanwhile, which can't clean up after this one
+		logrus.Infof("volume %s was removed while it lingered, unmounting it", name)
+		v = seaweedfsVolume{Name: name, Mountpoint: filepath.Join("/mnt/docker-volumes", name)}
+		if err := d.helpers.unmount(&v); err != nil {
+			logrus.Errorf("unmounting volume %s: %s", name, err)
+		}
+		if err := d.helpers.remove(name); err != nil {
+			logrus.Errorf("removing the helpers of volume %s: %s", name, err)
+		}
+		return
+	}
+	if err != nil {
+		logrus.Errorf("unmounting %s", volumeError(name, err))
+		return
+	}
+	node, err := getNodeName()
+	if err != nil {
+		logrus.Errorf("unmounting volume %s: cannot determine node name: %s", name, err)
+		return
+	}
+	if v.nodeMounts(node) != 0 {
+		return
+	}
+	logrus.Debugf("volume %s lingered for %s, unmounting", name, v.linger())
+	if err := d.helpers.unmount(&v); err != nil {
+		logrus.Errorf("unmounting volume %s: %s", name, err)
+	}
+}
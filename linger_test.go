@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// expireLinger runs the named volume's pending unmount right away.
+func expireLinger(t *testing.T, d *seaweedfsDriver, name string) {
+	d.lingersLock.Lock()
+	timer := d.lingers[name]
+	d.lingersLock.Unlock()
+	if timer == nil || !timer.Stop() {
+		t.Fatalf("no unmount pending for volume %s", name)
+	}
+	d.lingerExpired(name, timer)
+}
+
+func TestLingerExpired(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+	lingerTime = time.Hour
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 0, 0)
+	expireLinger(t, d, "test")
+	checkCounts(t, h, 1, 1, 0)
+}
+
+func TestLingerExpiredAfterRemove(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+	lingerTime = time.Hour
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// removed on another node, which doesn't know about this node's helper
+	if err := d.kv.Delete(keyPrefix + "test"); err != nil {
+		t.Fatal(err)
+	}
+	expireLinger(t, d, "test")
+	checkCounts(t, h, 1, 1, 1)
+}
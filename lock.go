@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// lockTTL is how long a volume lock outlives a plugin that stopped renewing it
+const lockTTL = 20 * time.Second
+
+// lockTimeout is how long a request waits for another request to release a
+// volume lock, set with LOCK_TIMEOUT. Mount holds it while pulling the helper
+// image and waiting for weed mount, so it has to be longer than MOUNT_TIMEOUT,
+// and shorter than the dockerMountDeadline.
+var lockTimeout time.Duration
+
+// dockerMountDeadline is how long Docker waits for a Mount to return. It gives
+// up on it after that, and never sends the matching Unmount.
+var dockerMountDeadline = 2 * time.Minute
+
+func checkLockTimeout() (err error) {
+	val := envOr("LOCK_TIMEOUT", "1m")
+	if lockTimeout, err = time.ParseDuration(val); err != nil || lockTimeout <= 0 {
+		return fmt.Errorf("unsupported LOCK_TIMEOUT %q, use a duration like 1m", val)
+	}
+	if lockTimeout <= mountTimeout {
+		return fmt.Errorf("LOCK_TIMEOUT %s has to be longer than MOUNT_TIMEOUT %s", lockTimeout, mountTimeout)
+	}
+	if lockTimeout >= dockerMountDeadline {
+		return fmt.Errorf("LOCK_TIMEOUT %s has to be shorter than the %s Docker waits for a mount", lockTimeout, dockerMountDeadline)
+	}
+	return nil
+}
+
+// lockKey is where the lock for the named volume lives, outside of keyPrefix
+// so that List does not see it.
+func lockKey(name string) string {
+	return strings.TrimSuffix(keyPrefix, "/") + "-locks/" + name
+}
+
+// lockVolume takes the swarm wide lock on the named volume, so that mounting,
+// unmounting and removing it does not interleave across nodes. The lock is
+// renewed until the returned unlock func is called.
+func (d *seaweedfsDriver) lockVolume(name string) (unlock func(), err error) {
+	node, err := getNodeName()
+	if err != nil {
+		return nil, err
+	}
+
+	renew := make(chan struct{}, 1)
+	var locker store.Locker
+	err = d.withStore(func(kv store.Store) (err error) {
+		locker, err = kv.NewLock(lockKey(name), &store.LockOptions{
+			Value:          []byte(node),
+			TTL:            lockTTL,
+			RenewLock:      renew,
+			DeleteOnUnlock: true,
+		})
+		return err
+	})
+	if err == store.ErrCallNotSupported {
+		// boltdb: the volumes are local to this node, so a local lock will do
+		return d.lockLocalVolume(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// stopRenew ends the lock renewal, and with etcd v3 its session. Consul
+	// closes the channel itself, but only on Unlock.
+	stopRenew := func(unlocked bool) {
+		if !unlocked || store.Backend(storeBackend) != store.CONSUL {
+			close(renew)
+		}
+	}
+
+	type lockResult struct {
+		lost <-chan struct{}
+		err  error
+	}
+	stop := make(chan struct{})
+	result := make(chan lockResult, 1)
+	go func() {
+		lost, err := locker.Lock(stop)
+		result <- lockResult{lost, err}
+	}()
+
+	var res lockResult
+	select {
+	case res = <-result:
+	case <-time.After(lockTimeout):
+		close(stop)
+		// not every backend gives up when asked to, release it if it turns up late
+		go func() {
+			res := <-result
+			unlocked := false
+			if res.err == nil && res.lost != nil {
+				locker.Unlock()
+				unlocked = true
+			}
+			stopRenew(unlocked)
+		}()
+		return nil, fmt.Errorf("timed out after %s waiting for the lock on volume %s, it is being changed by another node", lockTimeout, name)
+	}
+	if res.err == nil && res.lost == nil {
+		res.err = fmt.Errorf("lock request aborted")
+	}
+	if res.err != nil {
+		close(stop)
+		stopRenew(false)
+		return nil, fmt.Errorf("locking volume %s: %s", name, res.err)
+	}
+	logrus.Debugf("locked volume %s", name)
+
+	released := make(chan struct{})
+	go func() {
+		select {
+		case <-res.lost:
+			logrus.Warnf("lost the lock on volume %s before releasing it", name)
+		case <-released:
+		}
+	}()
+
+	return func() {
+		close(released)
+		if err := locker.Unlock(); err != nil {
+			logrus.Warnf("unlocking volume %s: %s", name, err)
+		}
+		close(stop)
+		stopRenew(true)
+		logrus.Debugf("unlocked volume %s", name)
+	}, nil
+}
+
+// lockLocalVolume takes an in-process lock on the named volume, for stores
+// that do not support locking.
+func (d *seaweedfsDriver) lockLocalVolume(name string) (unlock func(), err error) {
+	d.locksLock.Lock()
+	if d.locks == nil {
+		d.locks = map[string]chan struct{}{}
+	}
+	sem, ok := d.locks[name]
+	if !ok {
+		sem = make(chan struct{}, 1)
+		d.locks[name] = sem
+	}
+	d.locksLock.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	case <-time.After(lockTimeout):
+		return nil, fmt.Errorf("timed out after %s waiting for the lock on volume %s, it is being changed by another request", lockTimeout, name)
+	}
+
+	return func() { <-sem }, nil
+}
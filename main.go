@@ -2,34 +2,36 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
-	//"sync"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/sirupsen/logrus"
 
-	"github.com/abronan/valkeyrie"
 	"github.com/abronan/valkeyrie/store"
-	etcd "github.com/abronan/valkeyrie/store/etcd/v2"
 )
 
 // mostly swiped from https://github.com/vieux/docker-volume-sshfs/blob/master/main.go
 
+// socketAddress is where the plugin serves, its name has to agree with the
+// interface socket in config.json
 const socketAddress = "/run/docker/plugins/swarm.sock"
 
 // Version is set from the go build commandline
@@ -38,99 +40,130 @@ var Version string
 // CommitHash is set from the go build commandline
 var CommitHash string
 
-// ETCD prefix for volume info
-var keyPrefix = "/docker-seaweedfs-plugin/"
+// stateDir is where the plugin keeps its own files, on the plugin's state mount
+const stateDir = "/var/lib/docker/plugins/seaweedfs-volume-plugin"
 
-type seaweedfsVolume struct {
-	Options []string
+// remotePath is the filer directory new volumes are created in
+var remotePath = envOr("REMOTE_PATH", "/docker/volumes")
 
-	Name, Mountpoint string
-	connections      int
-}
+// helperImage is the image the mount helper containers run `weed mount` from,
+// by default the rootfs image of this very build
+var helperImage = envOr("HELPER_IMAGE", defaultHelperImage())
 
-type seaweedfsDriver struct {
-	root string
+// defaultHelperImage is the plugin's rootfs image tagged with the CommitHash it
+// was built from (see the Makefile), or the develop tag for other builds.
+func defaultHelperImage() string {
+	tag := CommitHash
+	if tag == "" {
+		tag = "develop"
+	}
+	return "svendowideit/seaweedfs-volume-plugin-rootfs:" + tag
 }
 
-func newseaweedfsDriver(root string) (*seaweedfsDriver, error) {
-	logrus.WithField("method", "new driver").Debug(root)
+// helperNetwork is the Docker network the mount helper containers use to reach the filer
+var helperNetwork = envOr("NETWORK", "seaweedfs_internal")
 
-	etcd.Register()
+type seaweedfsVolume struct {
+	// SchemaVersion is the version of this record's layout, see migrations
+	SchemaVersion int
 
-	d := &seaweedfsDriver{
-		root: filepath.Join(root, "volumes"),
-	}
+	Options []string
 
-	return d, nil
+	Name, Mountpoint string
+
+	// RemotePath is where the volume's data lives in the filer namespace
+	RemotePath string
+	// Filers are the filers of the SeaweedFS cluster the volume lives in
+	Filers []string
+	// Network is the Docker network its mount helper container reaches the filers on
+	Network string
+	// HelperImage overrides the plugin's helperImage for this volume
+	HelperImage string
+	// External is set for volumes of an existing filer directory (the path
+	// option), whose data the plugin must never delete
+	External bool
+
+	// Mounts maps each Docker MountRequest.ID to the node that requested it
+	Mounts map[string]string
 }
 
-func getStore() (s store.Store, err error) {
-	// Initialize a new store
-	kv, err := valkeyrie.NewStore(
-		store.ETCD,
-		[]string{"etcd:2379"},
-		&store.Config{
-			ConnectionTimeout: 5 * time.Second,
-		},
-	)
-	if err != nil {
-		log.Fatal("Cannot create store etcd (%s)", err)
-		return kv, err
+// image returns the image the volume's mount helper container runs.
+func (v *seaweedfsVolume) image() string {
+	if v.HelperImage != "" {
+		return v.HelperImage
 	}
-	return kv, nil
+	return helperImage
 }
 
-func getVolumeInfo(name string) (vol seaweedfsVolume, err error) {
-	kv, err := getStore()
-	if err != nil {
-		return vol, err
-	}
+// containerName returns the name of the volume's mount helper container.
+func (v *seaweedfsVolume) containerName() string {
+	return "seaweed-volume-plugin-" + v.Name
+}
 
-	pair, err := kv.Get(keyPrefix+name, nil)
-	if err != nil {
-		fmt.Errorf("Error trying accessing value at key: %v", name)
-		return vol, err
+// nodeMounts returns the number of mount IDs recorded for the given node.
+func (v *seaweedfsVolume) nodeMounts(node string) int {
+	count := 0
+	for _, n := range v.Mounts {
+		if n == node {
+			count++
+		}
 	}
+	return count
+}
 
-	if err := json.Unmarshal(pair.Value, &vol); err != nil {
-		return vol, err
-	}
+type seaweedfsDriver struct {
+	root string
 
-	return vol, err
-}
+	// kv is the store client shared by all requests, see getStore
+	kvLock  sync.Mutex
+	kv      store.Store
+	breaker circuitBreaker
 
-func updateVolumeInfo(vol seaweedfsVolume) error {
-	kv, err := getStore()
-	if err != nil {
-		return err
-	}
+	// in-process volume locks, for stores without locking support
+	locksLock sync.Mutex
+	locks     map[string]chan struct{}
 
-	data, err := json.Marshal(vol)
-	if err != nil {
-		logrus.WithField("vol", vol).Error(err)
-		return err
-	}
+	// pending unmounts of volumes no container on this node uses, see scheduleUnmount
+	lingersLock sync.Mutex
+	lingers     map[string]*time.Timer
 
-	err = kv.Put(keyPrefix+vol.Name, []byte(data), nil)
-	if err != nil {
-		fmt.Errorf("Error trying to put value at key: %v", vol.Name)
-	}
+	// helpers runs the volumes' mount helpers on this node
+	helpers helperRunner
 
-	return err
+	// started is when the plugin started, containers it created since then
+	// are not left over
+	started time.Time
+	// reconciled is closed once reconcileMounts is done, see waitReconciled
+	reconciled chan struct{}
 }
 
-func removeVolumeInfo(name string) error {
-	kv, err := getStore()
-	if err != nil {
-		return err
+func newseaweedfsDriver(root string) (*seaweedfsDriver, error) {
+	logrus.WithField("method", "new driver").Debug(root)
+
+	if err := initStore(); err != nil {
+		return nil, err
+	}
+	if err := checkPullPolicy(); err != nil {
+		return nil, err
+	}
+	if err := checkMountTimeout(); err != nil {
+		return nil, err
+	}
+	if err := checkLockTimeout(); err != nil {
+		return nil, err
+	}
+	if err := checkLinger(); err != nil {
+		return nil, err
 	}
 
-	err = kv.Delete(keyPrefix + name)
-	if err != nil {
-		fmt.Errorf("Error trying to delete key: %v", name)
+	d := &seaweedfsDriver{
+		root:       filepath.Join(root, "volumes"),
+		helpers:    dockerHelpers{},
+		started:    time.Now(),
+		reconciled: make(chan struct{}),
 	}
 
-	return err
+	return d, nil
 }
 
 // Create Instructs the plugin that the user wants to create a volume,
@@ -141,9 +174,32 @@ func (d *seaweedfsDriver) Create(r *volume.CreateRequest) error {
 	logrus.WithField("method", "create").Debugf("%#v", r)
 
 	var v seaweedfsVolume
+	v.RemotePath = path.Join(remotePath, r.Name)
+	v.Filers = filerHosts
+	v.Network = helperNetwork
+
+	keys := make([]string, 0, len(r.Options))
+	for key := range r.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	for key, val := range r.Options {
+	for _, key := range keys {
+		val := r.Options[key]
+		if err := validateOption(key, val); err != nil {
+			return logError("volume %s: %s", r.Name, err)
+		}
 		switch key {
+		case "path":
+			// expose an existing filer directory, rather than a new one for this volume
+			v.RemotePath = path.Clean(val)
+			v.External = true
+		case "filer":
+			v.Filers = splitList(val)
+		case "network":
+			v.Network = val
+		case "image":
+			v.HelperImage = val
 		default:
 			if val != "" {
 				v.Options = append(v.Options, key+"="+val)
@@ -156,8 +212,24 @@ func (d *seaweedfsDriver) Create(r *volume.CreateRequest) error {
 	v.Mountpoint = filepath.Join("/mnt/docker-volumes", r.Name)
 	v.Name = r.Name
 
-	if err := updateVolumeInfo(v); err != nil {
-		return err
+	userOpt, _ := optionValue(v.Options, "uid")
+	gidOpt, _ := optionValue(v.Options, "gid")
+	if _, _, err := resolveIDs(userOpt, gidOpt); err != nil {
+		return logError("volume %s: %s", r.Name, err)
+	}
+
+	if err := checkNetwork(v.Network); err != nil {
+		return logError("volume %s: %s", r.Name, err)
+	}
+
+	if v.External {
+		if err := checkFilerDir(&v); err != nil {
+			return logError("volume %s: %s", r.Name, err)
+		}
+	}
+
+	if err := d.createVolumeInfo(v); err != nil {
+		return volumeError(r.Name, err)
 	}
 
 	return nil
@@ -168,24 +240,44 @@ func (d *seaweedfsDriver) Create(r *volume.CreateRequest) error {
 func (d *seaweedfsDriver) Remove(r *volume.RemoveRequest) error {
 	logrus.WithField("method", "remove").Debugf("%#v", r)
 
-	v, err := getVolumeInfo(r.Name)
+	unlock, err := d.lockVolume(r.Name)
 	if err != nil {
-		return logError("volume %s not found", r.Name)
+		return volumeError(r.Name, err)
 	}
+	defer unlock()
 
-	if v.connections != 0 {
-		return logError("volume %s is currently used by a container", r.Name)
+	v, err := d.getVolumeInfo(r.Name)
+	if err != nil {
+		return volumeError(r.Name, err)
 	}
 
+	if err := checkUnused(&v); err != nil {
+		return volumeError(r.Name, err)
+	}
+	d.cancelUnmount(r.Name)
+
 	// if we unmount before the removeall, the data is kept in seaweedfs
-	if err = d.unmountVolume(&v); err != nil {
+	if err = d.helpers.unmount(&v); err != nil {
 		return err
 	}
+	if err := d.helpers.remove(r.Name); err != nil {
+		return logError(err.Error())
+	}
 
-	if err := os.RemoveAll(v.Mountpoint); err != nil {
+	if v.External {
+		// only remove the (empty) local mountpoint, in case the filer directory is still mounted
+		for _, dir := range []string{filepath.Join(v.Mountpoint, "_data"), v.Mountpoint} {
+			if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+				logError(err.Error())
+			}
+		}
+	} else if err := os.RemoveAll(v.Mountpoint); err != nil {
 		logError(err.Error())
 	}
-	removeVolumeInfo(r.Name)
+	// a container on another node may have started using it in the meantime
+	if err := d.removeVolumeInfo(r.Name, checkUnused); err != nil {
+		return volumeError(r.Name, err)
+	}
 	return nil
 }
 
@@ -193,12 +285,16 @@ func (d *seaweedfsDriver) Remove(r *volume.RemoveRequest) error {
 func (d *seaweedfsDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
 	logrus.WithField("method", "path").Debugf("%#v", r)
 
-	v, err := getVolumeInfo(r.Name)
+	v, err := d.getVolumeInfo(r.Name)
+	if err != nil {
+		return &volume.PathResponse{}, volumeError(r.Name, err)
+	}
+	mountpoint, err := hostPath(filepath.Join(v.Mountpoint, "_data"))
 	if err != nil {
-		return &volume.PathResponse{}, logError("volume %s not found", r.Name)
+		return &volume.PathResponse{}, logError(err.Error())
 	}
 
-	return &volume.PathResponse{Mountpoint: filepath.Join(getPluginDir(), "rootfs", v.Mountpoint, "_data")}, nil
+	return &volume.PathResponse{Mountpoint: mountpoint}, nil
 }
 
 // Mount is called once per container start.
@@ -209,14 +305,33 @@ func (d *seaweedfsDriver) Path(r *volume.PathRequest) (*volume.PathResponse, err
 // ID is a unique ID for the caller that is requesting the mount.
 func (d *seaweedfsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
 	logrus.WithField("method", "mount").Debugf("%#v", r)
+	start := time.Now()
+	d.waitReconciled()
 
-	v, err := getVolumeInfo(r.Name)
+	unlock, err := d.lockVolume(r.Name)
 	if err != nil {
-		return &volume.MountResponse{}, logError("volume %s not found", r.Name)
+		return &volume.MountResponse{}, volumeError(r.Name, err)
+	}
+	defer unlock()
+	// still mounted if it is lingering, so keep it that way
+	d.cancelUnmount(r.Name)
+
+	v, err := d.getVolumeInfo(r.Name)
+	if err != nil {
+		return &volume.MountResponse{}, volumeError(r.Name, err)
 	}
 	logrus.WithField("volume-info", r.Name).Debugf("%#v", v)
+	mountpoint, err := hostPath(filepath.Join(v.Mountpoint, "_data"))
+	if err != nil {
+		return &volume.MountResponse{}, logError(err.Error())
+	}
+
+	node, err := getNodeName()
+	if err != nil {
+		return &volume.MountResponse{}, logError("cannot determine node name: %s", err)
+	}
 
-	if v.connections == 0 {
+	if v.nodeMounts(node) == 0 {
 		fi, err := os.Lstat(v.Mountpoint)
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(v.Mountpoint, 0755); err != nil {
@@ -230,19 +345,36 @@ func (d *seaweedfsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse,
 			return &volume.MountResponse{}, logError("%v already exist and it's not a directory", v.Mountpoint)
 		}
 
-		if err := d.mountVolume(&v); err != nil {
+		if err := d.helpers.mount(&v); err != nil {
 			return &volume.MountResponse{}, logError(err.Error())
 		}
 	}
 
-	v.connections++
-	if err = updateVolumeInfo(v); err != nil {
-		logrus.WithField("method", "mount").WithField("updateVolumeInfo ERROR", err).Errorf("%#v", v)
-	} else {
-		logrus.WithField("method", "mount").WithField("updateVolumeInfo", r.Name).Debugf("%#v", v)
+	// Docker has given up on a Mount that took this long, and won't unmount it,
+	// so recording it would keep the volume in use until the plugin restarts
+	if elapsed := time.Since(start); elapsed >= dockerMountDeadline {
+		if v.nodeMounts(node) == 0 {
+			if err := d.scheduleUnmount(&v); err != nil {
+				logrus.Warnf("unmounting volume %s: %s", r.Name, err)
+			}
+		}
+		return &volume.MountResponse{}, logError("volume %s: mounting took %s, longer than Docker waits for it", r.Name, elapsed)
+	}
+
+	v, err = d.modifyVolumeInfo(r.Name, func(v *seaweedfsVolume) error {
+		if v.Mounts == nil {
+			v.Mounts = map[string]string{}
+		}
+		v.Mounts[r.ID] = node
+		return nil
+	})
+	if err != nil {
+		logrus.WithField("method", "mount").WithField("modifyVolumeInfo ERROR", err).Errorf("%#v", v)
+		return &volume.MountResponse{}, volumeError(r.Name, err)
 	}
+	logrus.WithField("method", "mount").WithField("modifyVolumeInfo", r.Name).Debugf("%#v", v)
 
-	return &volume.MountResponse{Mountpoint: filepath.Join(getPluginDir(), "rootfs", v.Mountpoint, "_data")}, nil
+	return &volume.MountResponse{Mountpoint: mountpoint}, nil
 }
 
 // Docker is no longer using the named volume.
@@ -251,32 +383,41 @@ func (d *seaweedfsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse,
 // ID is a unique ID for the caller that is requesting the mount.
 func (d *seaweedfsDriver) Unmount(r *volume.UnmountRequest) error {
 	logrus.WithField("method", "unmount").Debugf("%#v", r)
+	d.waitReconciled()
 
-	v, err := getVolumeInfo(r.Name)
+	unlock, err := d.lockVolume(r.Name)
 	if err != nil {
-		return logError("volume %s not found", r.Name)
+		return volumeError(r.Name, err)
 	}
+	defer unlock()
 
-	v.connections--
-
-	// TODO: OMG - how to make a shared concept of this??
-	// TODO: I think it might be easier to not unmount until there are no more nodes using it (for now)
-	//       Later, can keep a hash of how many mounts on each node...
-	err = updateVolumeInfo(v)
-	if err = updateVolumeInfo(v); err != nil {
-		logrus.WithField("updateVolumeInfo ERROR", err).Errorf("%#v", v)
-	} else {
-		logrus.WithField("updateVolumeInfo", r.Name).Debugf("%#v", v)
+	v, err := d.getVolumeInfo(r.Name)
+	if err != nil {
+		return volumeError(r.Name, err)
 	}
 
-	// get some interesting speedups by keeping the fusemount container running
-	return nil
+	node, err := getNodeName()
+	if err != nil {
+		return logError("cannot determine node name: %s", err)
+	}
 
-	if v.connections <= 0 {
-		v.connections = 0
-		updateVolumeInfo(v)
+	v, err = d.modifyVolumeInfo(r.Name, func(v *seaweedfsVolume) error {
+		if _, ok := v.Mounts[r.ID]; ok {
+			delete(v.Mounts, r.ID)
+		} else if id := reconciledMount(v, node); id != "" {
+			// mounted before the plugin restarted, under an ID it made up
+			delete(v.Mounts, id)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithField("modifyVolumeInfo ERROR", err).Errorf("%#v", v)
+		return volumeError(r.Name, err)
+	}
+	logrus.WithField("modifyVolumeInfo", r.Name).Debugf("%#v", v)
 
-		if err = d.unmountVolume(&v); err != nil {
+	if v.nodeMounts(node) == 0 {
+		if err = d.scheduleUnmount(&v); err != nil {
 			return err
 		}
 	}
@@ -284,14 +425,14 @@ func (d *seaweedfsDriver) Unmount(r *volume.UnmountRequest) error {
 	return nil
 }
 
-func (d *seaweedfsDriver) unmountVolume(v *seaweedfsVolume) error {
+func unmountVolume(v *seaweedfsVolume) error {
 	ctx := context.Background()
 	cli, err := GetDockerClient(ctx, "")
 	if err != nil {
 		return err
 	}
 
-	volumeContainer := "seaweed-volume-plugin-" + v.Name
+	volumeContainer := v.containerName()
 	logrus.Debugf("Unmount(%s) requested", v.Mountpoint)
 
 	execID, err := cli.ContainerExecCreate(ctx,
@@ -333,21 +474,20 @@ func (d *seaweedfsDriver) unmountVolume(v *seaweedfsVolume) error {
 	}
 
 	stats, err := cli.ContainerInspect(ctx, volumeContainer)
+	if client.IsErrNotFound(err) {
+		// never mounted on this node
+		return nil
+	}
 	if err != nil {
 		return logError("Unmount ContainerInspect: %s", err)
 	}
 	logrus.Debugf("ContainerInspect: %#v", stats)
-
-	// if err := cli.ContainerRemove(ctx,
-	// 	stats.ID,
-	// 	types.ContainerRemoveOptions{
-	// 		RemoveVolumes: true,
-	// 		RemoveLinks:   true,
-	// 		Force:         true,
-	// 	},
-	// ); err != nil {
-	// 	return logError("Unmount ContainerRemove: %s", err)
-	// }
+	if stats.State.Running {
+		timeout := 10 * time.Second
+		if err := cli.ContainerStop(ctx, stats.ID, &timeout); err != nil {
+			return logError("Unmount ContainerStop: %s", err)
+		}
+	}
 	return nil
 }
 
@@ -355,16 +495,33 @@ func (d *seaweedfsDriver) unmountVolume(v *seaweedfsVolume) error {
 func (d *seaweedfsDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
 	logrus.WithField("method", "get").Debugf("%#v", r)
 
-	v, err := getVolumeInfo(r.Name)
+	v, err := d.getVolumeInfo(r.Name)
 	if err != nil {
-		return &volume.GetResponse{}, logError("volume %s not found", r.Name)
+		return &volume.GetResponse{}, volumeError(r.Name, err)
 	}
 
 	logrus.WithField("get", "volumeinfo").Debugf("%#v", v)
 
+	mountpoint, err := hostPath(filepath.Join(v.Mountpoint, "_data"))
+	if err != nil {
+		return &volume.GetResponse{}, logError(err.Error())
+	}
+	digest, err := imageDigest(v.containerName(), v.image())
+	if err != nil {
+		digest = err.Error()
+	}
+
 	return &volume.GetResponse{Volume: &volume.Volume{
 		Name:       r.Name,
-		Mountpoint: filepath.Join(getPluginDir(), "rootfs", v.Mountpoint, "_data"),
+		Mountpoint: mountpoint,
+		Status: map[string]interface{}{
+			"RemotePath":  v.RemotePath,
+			"Filers":      v.Filers,
+			"Network":     v.Network,
+			"Image":       v.image(),
+			"ImageDigest": digest,
+			"External":    v.External,
+		},
 	}}, nil
 }
 
@@ -373,25 +530,21 @@ func (d *seaweedfsDriver) List() (*volume.ListResponse, error) {
 	logrus.WithField("method", "list").Debugf("version %s, build %s\n", Version, CommitHash)
 
 	var vols []*volume.Volume
-	kv, err := getStore()
-	if err != nil {
-		return &volume.ListResponse{Volumes: vols}, err
-	}
-	entries, err := kv.List(keyPrefix, &store.ReadOptions{Consistent: true})
+	entries, err := d.listVolumeInfo()
 	if err != nil {
 		return &volume.ListResponse{Volumes: vols}, err
 	}
-	for _, pair := range entries {
-		v, err := getVolumeInfo(pair.Key) // TODO: extract this / just unmarshal the json..
+	for _, v := range entries {
+		mountpoint, err := hostPath(filepath.Join(v.Mountpoint, "_data"))
 		if err != nil {
 			return &volume.ListResponse{Volumes: vols}, err
 		}
 		thisVol := volume.Volume{
 			Name:       v.Name,
-			Mountpoint: filepath.Join(getPluginDir(), "rootfs", v.Mountpoint, "_data"),
+			Mountpoint: mountpoint,
 		}
 		vols = append(vols, &thisVol)
-		logrus.WithField("list", pair.Key).Debugf("returns %#v\n", thisVol)
+		logrus.WithField("list", v.Name).Debugf("returns %#v\n", thisVol)
 	}
 
 	return &volume.ListResponse{Volumes: vols}, nil
@@ -402,10 +555,114 @@ func (d *seaweedfsDriver) List() (*volume.ListResponse, error) {
 func (d *seaweedfsDriver) Capabilities() *volume.CapabilitiesResponse {
 	logrus.WithField("method", "capabilities").Debugf("version %s, build %s\n", Version, CommitHash)
 
-	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "local"}}
+	// volumes kept in a shared store are visible on every node
+	scope := "global"
+	if isLocalStore() {
+		scope = "local"
+	}
+	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: scope}}
+}
+
+// pickFilerScript runs the weed mount command given after the comma separated
+// filers in $1 against the first of them that answers, as they are assumed to
+// be filers of the same cluster. It runs in the helper, where their names resolve.
+const pickFilerScript = `filers=$1; shift
+IFS=,
+for filer in $filers; do
+	if wget -q -T 3 -O /dev/null "http://$filer/" 2>/dev/null; then
+		unset IFS
+		exec "$@" -filer="$filer"
+	fi
+	echo "filer $filer is not reachable" >&2
+done
+echo "no filer reachable" >&2
+exit 1`
+
+// helperConfig is the configuration of the container running weed mount for
+// the volume, mounting it from the first of its filers that answers.
+func helperConfig(v *seaweedfsVolume) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+	userOpt, _ := optionValue(v.Options, "uid")
+	gidOpt, _ := optionValue(v.Options, "gid")
+	uid, gid, err := resolveIDs(userOpt, gidOpt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	volumesDir, err := hostPath("/mnt/docker-volumes/")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	args := weedMountArgs(v.Options)
+	// without allow_other only the helper's own uid (and not even root) can get
+	// into the mount, rather than the containers using the volume
+	if _, ok := optionValue(v.Options, "allowOthers"); !ok {
+		args = append(args, "-allowOthers=true")
+	}
+	mounts := []mount.Mount{
+		{
+			Type: mount.TypeBind,
+			// TODO: figure out what the propagated-mount dir is (it works when the plugin is installed, but not using plain containers)
+			//Source:   getPluginDir() + "/propagated-mount/",
+			Source:   volumesDir,
+			Target:   "/mnt/docker-volumes/",
+			ReadOnly: false,
+			BindOptions: &mount.BindOptions{
+				Propagation:  mount.PropagationRShared,
+				NonRecursive: false,
+			},
+		}}
+	if uid != 0 {
+		fuseConfFile, err := hostPath(fuseConf)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   fuseConfFile,
+			Target:   "/etc/fuse.conf",
+			ReadOnly: true,
+		})
+	}
+
+	return &container.Config{
+			Image:      v.image(),
+			Labels:     pluginLabels(v.Name),
+			User:       fmt.Sprintf("%d:%d", uid, gid),
+			Entrypoint: []string{"sh", "-c", pickFilerScript, "sh", strings.Join(v.Filers, ",")},
+			Cmd: append([]string{
+				"weed",
+				"-v", "2",
+				"mount",
+				"-dir=" + v.Mountpoint + "/_data",
+				"-filer.path=" + v.RemotePath,
+			}, args...),
+		},
+		&container.HostConfig{
+			//AutoRemove: true,
+			//Priviledged: true,
+			CapAdd: []string{"SYS_ADMIN"},
+			Resources: container.Resources{
+				Devices: []container.DeviceMapping{container.DeviceMapping{
+					PathOnHost:        "/dev/fuse",
+					PathInContainer:   "/dev/fuse",
+					CgroupPermissions: "rwm", // needs Cap=SYS_ADMIN
+				}},
+			},
+			Mounts:      mounts,
+			SecurityOpt: []string{"apparmor=unconfined"},
+		},
+		&network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				v.Network: {},
+			},
+		}, nil
 }
 
-func (d *seaweedfsDriver) mountVolume(v *seaweedfsVolume) error {
+// fuseConf is the fuse.conf given to helpers running weed mount as non-root.
+// It sits next to the volume mountpoints, where no volume name can clash with it.
+const fuseConf = "/mnt/docker-volumes/.fuse.conf"
+
+func mountVolume(v *seaweedfsVolume) error {
 	logrus.WithField("method", "mountVolume").Debugf("volinfo: %#v", *v)
 
 	// TODO: need to do something with the options (uid mapping would rock)
@@ -415,61 +672,17 @@ func (d *seaweedfsDriver) mountVolume(v *seaweedfsVolume) error {
 
 	// TODO: to make a mount available to a different user
 	os.MkdirAll(v.Mountpoint, 0777)
-	var userOpt, gidOpt, uMask string
-	for _, option := range v.Options {
-		//cmd.Args = append(cmd.Args, "-o", option)
-		if strings.HasPrefix(option, "uid=") {
-			userOpt = strings.TrimPrefix(option, "uid=")
-		}
-		if strings.HasPrefix(option, "gid=") {
-			gidOpt = strings.TrimPrefix(option, "gid=")
-		}
-		if strings.HasPrefix(option, "umask=") {
-			uMask = strings.TrimPrefix(option, "umask=")
-		}
-		logrus.Debugf("option: (%s)", option)
+	userOpt, _ := optionValue(v.Options, "uid")
+	gidOpt, _ := optionValue(v.Options, "gid")
+	modeOpt, _ := optionValue(v.Options, "mode")
+	uid, gid, err := resolveIDs(userOpt, gidOpt)
+	if err != nil {
+		return err
 	}
-	uid, gid := 0, 0
-	if userOpt != "" {
-		logrus.Debugf("userOpt: (%s)", userOpt)
-		u, err := user.Lookup(userOpt)
-		if err != nil {
-			u, err = user.LookupId(userOpt)
-		}
-		user := userOpt
-		group := gidOpt
-		if err == nil && u != nil {
-			user = u.Uid
-			if group != "" {
-				group = u.Gid
-			}
-		}
-
-		logrus.Debugf("u: (%#v)", u)
-		if parsedID, pe := strconv.ParseUint(user, 10, 32); pe == nil {
-			uid = int(parsedID)
-		}
-		if parsedID, pe := strconv.ParseUint(group, 10, 32); pe == nil {
-			gid = int(parsedID)
-		}
+	if userOpt != "" || gidOpt != "" {
 		logrus.Debugf("chown: (%s, %d, %d)", v.Mountpoint, uid, gid)
 		os.Chown(v.Mountpoint, uid, gid)
-
 	}
-	fi, _ := os.Lstat(v.Mountpoint)
-	mode := fi.Mode()
-	if uMask != "" {
-		if parsedID, pe := strconv.ParseUint(uMask, 8, 32); pe == nil {
-			mode = os.FileMode(parsedID)
-			logrus.Debugf("chmod(%s, %#o)", v.Mountpoint, mode)
-
-			os.Chmod(v.Mountpoint, mode)
-
-			fi, _ := os.Lstat(v.Mountpoint)
-			logrus.Debugf("mode(%s): %v\n", fi.Mode(), v.Mountpoint)
-		}
-	}
-
 	// output, err := runCmd(
 	// 	"docker",
 	// 	"run",
@@ -491,169 +704,153 @@ func (d *seaweedfsDriver) mountVolume(v *seaweedfsVolume) error {
 	// 	"-filer.path="+v.Mountpoint,
 	// )
 
-	// TODO: what should we do if there already is one - atm, the output to the user "ok"
-	// the error maybe should be to tell them there is somethign wrong, and they might be able to fix it
-	// if they force kill the plugin-vol (so long as its not yet in use?) - and then remove the mount point, and ???
-	// OR if the settings are right, we could just reuse it?
+	if len(v.Filers) == 0 {
+		return fmt.Errorf("no filer set for volume %s", v.Name)
+	}
 
-	containerName := "seaweed-volume-plugin-" + v.Name
+	containerName := v.containerName()
+	dataDir := filepath.Join(v.Mountpoint, "_data")
+	os.MkdirAll(dataDir, 0755)
 
-	_, err := runContainer(
-		&container.Config{
-			Image:      "svendowideit/seaweedfs-volume-plugin-rootfs:develop",
-			User:       fmt.Sprintf("%d", uid),
-			Entrypoint: []string{"weed"},
-			Cmd: []string{
-				"-v", "2",
-				"mount",
-				"-filer=filer:8888",
-				"-dir=" + v.Mountpoint + "/_data",
-				"-filer.path=" + v.Mountpoint,
-			},
-		},
-		&container.HostConfig{
-			//AutoRemove: true,
-			//Priviledged: true,
-			CapAdd: []string{"SYS_ADMIN"},
-			Resources: container.Resources{
-				Devices: []container.DeviceMapping{container.DeviceMapping{
-					PathOnHost:        "/dev/fuse",
-					PathInContainer:   "/dev/fuse",
-					CgroupPermissions: "rwm", // needs Cap=SYS_ADMIN
-				}},
-			},
-			Mounts: []mount.Mount{
-				{
-					Type: mount.TypeBind,
-					// TODO: figure out what the propagated-mount dir is (it works when the plugin is installed, but not using plain containers)
-					//Source:   getPluginDir() + "/propagated-mount/",
-					Source:   getPluginDir() + "/rootfs/mnt/docker-volumes/",
-					Target:   "/mnt/docker-volumes/",
-					ReadOnly: false,
-					BindOptions: &mount.BindOptions{
-						Propagation:  mount.PropagationRShared,
-						NonRecursive: false,
-					},
-				}},
-			SecurityOpt: []string{"apparmor=unconfined"},
-		},
-		&network.NetworkingConfig{
-			EndpointsConfig: map[string]*network.EndpointSettings{
-				"seaweedfs_internal": {},
-			},
-		},
+	if uid != 0 {
+		// fusermount refuses allow_other to non-root users, unless the helper
+		// image's /etc/fuse.conf has user_allow_other, so bring our own
+		if err := ioutil.WriteFile(fuseConf, []byte("user_allow_other\n"), 0644); err != nil {
+			return logError("Error writing %s: %s", fuseConf, err)
+		}
+	}
+
+	// an existing helper is reused if it was created from the same config, and replaced if not
+	config, hostConfig, networkingConfig, err := helperConfig(v)
+	if err != nil {
+		return err
+	}
+	_, err = runContainer(
+		config,
+		hostConfig,
+		networkingConfig,
 		containerName,
 	)
 	logrus.WithField("method", "mountVolume").Debugf("Started %s", containerName)
 	if err != nil {
 		return logError("Error runing Container: %s", err)
 	}
-	// TODO: test that we have actually mounted
+	// otherwise docker would bind mount the empty local directory, and the data ends up on this node's disk
+	if err := waitForMount(dataDir, containerName); err != nil {
+		return fmt.Errorf("Error mounting volume %s: %s", v.Name, err)
+	}
 
-	dataDir := filepath.Join(v.Mountpoint, "_data")
-	os.MkdirAll(dataDir, mode)
 	os.Chown(dataDir, uid, gid)
+	// the umask is applied by weed mount, mode only sets the volume's root directory
+	if modeOpt != "" {
+		if parsedMode, pe := strconv.ParseUint(modeOpt, 8, 32); pe == nil {
+			logrus.Debugf("chmod(%s, %#o)", dataDir, parsedMode)
+			os.Chmod(dataDir, os.FileMode(parsedMode))
+		}
+	}
 
 	return nil
 }
 
-var pluginDir = ""
+// pluginDir is where Docker keeps the plugin, set with PLUGIN_DIR if it is not
+// installed as a managed plugin (eg. run as a swarm service), and otherwise
+// looked up by getPluginDir
+var pluginDir = envOr("PLUGIN_DIR", "")
+
+// pluginName is the name Docker knows the plugin by, and lists as the driver
+// of its volumes. It is looked up along with the pluginDir, and otherwise it is
+// the name of the socket, as for a plugin that isn't managed.
+var pluginName = strings.TrimSuffix(filepath.Base(socketAddress), ".sock")
 
-func getPluginDir() string {
+// getPluginDir returns the plugin's directory on the host, where the helper
+// containers find its rootfs. It is looked up once, in the list of managed
+// plugins, as the one serving our socket or built from the same commit.
+func getPluginDir() (string, error) {
 	if pluginDir != "" {
-		return pluginDir
+		return pluginDir, nil
 	}
-	// write a unique filename to /tmp
-	content := []byte("temporary file's content")
-	tmpfile, err := ioutil.TempFile("/tmp", "example")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer os.Remove(tmpfile.Name()) // clean up
 
-	if _, err := tmpfile.Write(content); err != nil {
-		log.Fatal(err)
-	}
-	if err := tmpfile.Close(); err != nil {
-		log.Fatal(err)
+	ctx := context.Background()
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return "", err
 	}
-	// start a container with access to /var/lib/docker/plugins/ and search for that file in */rootfs/tmp
-	filename := strings.TrimPrefix(tmpfile.Name(), "/tmp/")
-
-	containerID, err := runContainer(
-		&container.Config{
-			Image:      "svendowideit/seaweedfs-volume-plugin-rootfs:develop",
-			Entrypoint: []string{"find"},
-			Cmd:        []string{"/var/lib/docker/plugins/", "-name", filename},
-		},
-		&container.HostConfig{
-			Mounts: []mount.Mount{
-				{
-					Type:   mount.TypeBind,
-					Source: "/var/lib/docker/plugins/",
-					Target: "/var/lib/docker/plugins/",
-				}},
-		},
-		&network.NetworkingConfig{},
-		"",
-	)
+	// Docker only marks the plugin enabled once it serves, so this one isn't yet
+	// when it is first enabled
+	plugins, err := cli.PluginList(ctx, filters.NewArgs())
 	if err != nil {
-		logError("Error runing Container: %s", err)
-		return ""
+		return "", fmt.Errorf("listing plugins: %s", err)
+	}
+
+	socket := filepath.Base(socketAddress)
+	version := fmt.Sprintf("docker-plugin-seaweedfs: %s %s", Version, CommitHash)
+	var bySocket, byVersion, byBoth []*types.Plugin
+	for _, p := range plugins {
+		socketMatch := p.Config.Interface.Socket == socket
+		versionMatch := false
+		for _, env := range p.Config.Env {
+			if env.Name == "VERSION" && env.Description == version {
+				versionMatch = true
+			}
+		}
+		if socketMatch {
+			bySocket = append(bySocket, p)
+		}
+		if versionMatch {
+			byVersion = append(byVersion, p)
+		}
+		if socketMatch && versionMatch {
+			byBoth = append(byBoth, p)
+		}
 	}
 
-	// TODO: it'd be nice not to need this more than once
-	ctx := context.Background()
-	cli, err := GetDockerClient(ctx, "")
-	if err != nil {
-		logError("Error getting Docker client: %s", err)
-		return ""
-	}
-	// defer func() {
-	// 	if err := cli.ContainerRemove(ctx,
-	// 		containerID,
-	// 		types.ContainerRemoveOptions{
-	// 			RemoveVolumes: true,
-	// 			RemoveLinks:   true,
-	// 			Force:         true,
-	// 		},
-	// 	); err != nil {
-	// 		logError("findPlugin ContainerRemove(%s): %s", containerID, err)
-	// 	}
-	// }()
-
-	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		if err != nil {
-			logError("Error waiting for Container: %s", err)
-			return ""
+	var found *types.Plugin
+	for _, matches := range [][]*types.Plugin{byBoth, byVersion, bySocket} {
+		if len(matches) > 1 {
+			// of several installs, the one being enabled is the one starting
+			var starting []*types.Plugin
+			for _, p := range matches {
+				if !p.Enabled {
+					starting = append(starting, p)
+				}
+			}
+			if len(starting) == 1 {
+				matches = starting
+			}
 		}
-	case <-statusCh:
+		if len(matches) == 1 {
+			found = matches[0]
+			break
+		}
+		if len(matches) > 1 {
+			var names []string
+			for _, p := range matches {
+				names = append(names, p.Name)
+			}
+			return "", fmt.Errorf("cannot tell which of the plugins %s this is, set PLUGIN_DIR", strings.Join(names, ", "))
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("no plugin serves %s or is %q, set PLUGIN_DIR if this is not a managed plugin", socket, version)
 	}
 
-	out, err := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{ShowStdout: true})
-	if err != nil {
-		logError("Error creating Container: %s", err)
-		return ""
-	}
-	//stdcopy.StdCopy(os.Stdout, os.Stderr, out)
-	output, err := ioutil.ReadAll(out)
-	logrus.Debugf("Find file (%s): (Err: %s ) Output: %s", filename, err, output)
-	// TODO: find out why there's leading unicode in output..
-	// ' \\x01\\x00\\x00\\x00\\x00\\x00\\x00u/var/lib/docker/plug....'
-	if err != nil {
-		logError("FindFile: %s", err)
-		return ""
+	dir := filepath.Join("/var/lib/docker/plugins", found.ID)
+	if _, err := os.Stat(filepath.Join(dir, "rootfs")); err != nil {
+		return "", fmt.Errorf("plugin %s: %s", found.Name, err)
 	}
+	logrus.Debugf("this is plugin %s (%s)", found.Name, found.ID)
+	pluginDir = dir
+	pluginName = found.Name
+	return pluginDir, nil
+}
 
-	pluginDir = strings.TrimSpace(string(output))
-	// remove the leading unicode
-	pluginDir = pluginDir[strings.Index(pluginDir, "/var/lib/docker/plugins/"):]
-	pluginDir = strings.TrimSuffix(pluginDir, "/rootfs"+tmpfile.Name())
-	logrus.Debug(pluginDir)
-	return pluginDir
+// hostPath returns where p, a path in the plugin's rootfs, is on the host.
+func hostPath(p string) (string, error) {
+	dir, err := getPluginDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rootfs", p), nil
 }
 
 func logError(format string, args ...interface{}) error {
@@ -682,11 +879,31 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 	logrus.Infof("Version %s, build %s\n", Version, CommitHash)
+	logrus.Infof("Store: %s %v (prefix %s)", storeBackend, storeEndpoints, keyPrefix)
+	logrus.Infof("Filers: %v on network %s", filerHosts, helperNetwork)
+	logrus.Infof("Helper image: %s (pull %s)", helperImage, pullPolicy)
 
-	pluginDir := getPluginDir()
-	logrus.Infof("Plugin dir: %s", pluginDir)
+	// one-shot upgrade of all the volume records, eg. before rolling out a new plugin
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		d, err := newseaweedfsDriver("/mnt")
+		if err != nil {
+			log.Fatal(err)
+		}
+		count, err := d.migrateVolumes()
+		logrus.Infof("migrated %d volume records to schema version %d", count, volumeSchemaVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	_, err := os.Lstat("/run/docker.sock")
+	pluginDir, err := getPluginDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logrus.Infof("Plugin dir: %s (plugin %s)", pluginDir, pluginName)
+
+	_, err = os.Lstat("/run/docker.sock")
 	if os.IsNotExist(err) {
 		log.Fatal(err)
 	}
@@ -695,6 +912,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// while serving already, so that Docker doesn't give up on the plugin when
+	// the store is slow, Mount and Unmount wait for it
+	go func() {
+		if err := d.reconcileMounts(); err != nil {
+			logrus.Warn(err)
+		}
+		close(d.reconciled)
+		if err := d.collectContainers(); err != nil {
+			logrus.Warn(err)
+		}
+		if err := d.reconcileHelpers(); err != nil {
+			logrus.Warn(err)
+		}
+	}()
 	h := volume.NewHandler(d)
 	logrus.Infof("listening on %s", socketAddress)
 
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// fakeHelpers counts what the driver asks of the mount helpers, instead of
+// running containers.
+type fakeHelpers struct {
+	lock                      sync.Mutex
+	mounts, unmounts, removes int
+}
+
+func (h *fakeHelpers) mount(v *seaweedfsVolume) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.mounts++
+	return nil
+}
+
+func (h *fakeHelpers) unmount(v *seaweedfsVolume) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.unmounts++
+	return nil
+}
+
+func (h *fakeHelpers) remove(name string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.removes++
+	return nil
+}
+
+func (h *fakeHelpers) counts() (mounts, unmounts, removes int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.mounts, h.unmounts, h.removes
+}
+
+// newTestDriver returns a driver on node1 with an in-memory store holding the
+// volume test, and a cleanup func.
+func newTestDriver(t *testing.T) (*seaweedfsDriver, *fakeHelpers, func()) {
+	nodeName = "node1"
+	pluginDir = "/var/lib/docker/plugins/test"
+	lingerTime = 0
+	lockTimeout = time.Minute
+
+	dir, err := ioutil.TempDir("", "seaweedfs-volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	helpers := &fakeHelpers{}
+	d := &seaweedfsDriver{kv: newMemStore(), helpers: helpers}
+	if err := d.createVolumeInfo(seaweedfsVolume{Name: "test", Mountpoint: dir, Filers: []string{"filer:8888"}}); err != nil {
+		t.Fatal(err)
+	}
+	return d, helpers, func() { os.RemoveAll(dir) }
+}
+
+func nodeMounts(t *testing.T, d *seaweedfsDriver, node string) int {
+	v, err := d.getVolumeInfo("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.nodeMounts(node)
+}
+
+func checkCounts(t *testing.T, h *fakeHelpers, mounts, unmounts, removes int) {
+	t.Helper()
+	if m, u, r := h.counts(); m != mounts || u != unmounts || r != removes {
+		t.Errorf("helper mounts, unmounts, removes = %d, %d, %d, want %d, %d, %d", m, u, r, mounts, unmounts, removes)
+	}
+}
+
+func TestMountUnmountRefCount(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCounts(t, h, 1, 0, 0)
+	if n := nodeMounts(t, d, "node1"); n != 2 {
+		t.Errorf("%d mounts after mounting twice, want 2", n)
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 0, 0)
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 1, 0)
+	if n := nodeMounts(t, d, "node1"); n != 0 {
+		t.Errorf("%d mounts after unmounting all, want 0", n)
+	}
+
+	// mounting again starts the helper again
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 2, 1, 0)
+}
+
+func TestMountsAreCountedPerNode(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// another node has it mounted, this one still needs its own helper
+	if _, err := d.modifyVolumeInfo("test", func(v *seaweedfsVolume) error {
+		v.Mounts = map[string]string{"other": "node2"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 0, 0)
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 1, 0)
+	if n := nodeMounts(t, d, "node2"); n != 1 {
+		t.Errorf("%d mounts left on node2, want 1", n)
+	}
+
+	err := d.Remove(&volume.RemoveRequest{Name: "test"})
+	if err == nil || !strings.Contains(err.Error(), "currently used by 1 container") {
+		t.Errorf("removing a volume used on another node: %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	err := d.Remove(&volume.RemoveRequest{Name: "test"})
+	if err == nil || !strings.Contains(err.Error(), "currently used by 1 container") {
+		t.Errorf("removing a mounted volume: %v", err)
+	}
+	checkCounts(t, h, 1, 0, 0)
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(&volume.RemoveRequest{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 2, 1)
+	if _, err := d.getVolumeInfo("test"); err != store.ErrKeyNotFound {
+		t.Errorf("volume record after Remove: %v", err)
+	}
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "b"}); err == nil {
+		t.Error("mounted a removed volume")
+	}
+}
+
+func TestMountPastDockerDeadline(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+	defer func(deadline time.Duration) { dockerMountDeadline = deadline }(dockerMountDeadline)
+	// every Mount takes longer than this
+	dockerMountDeadline = 0
+
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "a"}); err == nil {
+		t.Error("a Mount Docker gave up on succeeded")
+	}
+	if n := nodeMounts(t, d, "node1"); n != 0 {
+		t.Errorf("%d mounts recorded after a Mount Docker gave up on, want 0", n)
+	}
+	checkCounts(t, h, 1, 1, 0)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// migrations upgrade a raw volume record from schema version i to i+1. Once a
+// plugin writing a schema version is released, only ever append to this list.
+var migrations = []func(record map[string]interface{}) error{
+	// 0: unversioned records, from before the mount IDs were persisted
+	func(record map[string]interface{}) error {
+		if _, ok := record["Mounts"]; !ok {
+			record["Mounts"] = map[string]interface{}{}
+		}
+		return nil
+	},
+	// 1: the filer path used to be the same as the local mountpoint
+	func(record map[string]interface{}) error {
+		if _, ok := record["RemotePath"]; !ok {
+			record["RemotePath"] = record["Mountpoint"]
+		}
+		return nil
+	},
+	// 2: all volumes used to be mounted from the seaweedfs stack's filer
+	func(record map[string]interface{}) error {
+		if _, ok := record["Filers"]; !ok {
+			record["Filers"] = []interface{}{"filer:8888"}
+		}
+		return nil
+	},
+	// 3: and their mount helpers always joined the seaweedfs stack's network
+	func(record map[string]interface{}) error {
+		if _, ok := record["Network"]; !ok {
+			record["Network"] = "seaweedfs_internal"
+		}
+		return nil
+	},
+	// 4: umask used to be the mode of the volume's root directory
+	func(record map[string]interface{}) error {
+		options, _ := record["Options"].([]interface{})
+		for i, option := range options {
+			if s, ok := option.(string); ok && strings.HasPrefix(s, "umask=") {
+				options[i] = "mode=" + strings.TrimPrefix(s, "umask=")
+			}
+		}
+		return nil
+	},
+}
+
+// volumeSchemaVersion is the version of the volume records this plugin writes
+var volumeSchemaVersion = len(migrations)
+
+// decodeVolumeInfo decodes a stored volume record, migrating it to the current
+// schema version first if it is older. migrated tells whether it was.
+func decodeVolumeInfo(data []byte) (vol seaweedfsVolume, migrated bool, err error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return vol, false, err
+	}
+
+	version := 0
+	if v, ok := record["SchemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > volumeSchemaVersion {
+		return vol, false, fmt.Errorf("record has schema version %d, this plugin only knows up to %d", version, volumeSchemaVersion)
+	}
+	for ; version < volumeSchemaVersion; version++ {
+		if err := migrations[version](record); err != nil {
+			return vol, false, fmt.Errorf("migrating record from schema version %d: %s", version, err)
+		}
+		record["SchemaVersion"] = version + 1
+		migrated = true
+	}
+
+	if migrated {
+		if data, err = json.Marshal(record); err != nil {
+			return vol, false, err
+		}
+	}
+	err = json.Unmarshal(data, &vol)
+	return vol, migrated, err
+}
+
+// encodeVolumeInfo encodes a volume record at the current schema version.
+func encodeVolumeInfo(vol seaweedfsVolume) ([]byte, error) {
+	vol.SchemaVersion = volumeSchemaVersion
+	data, err := json.Marshal(vol)
+	if err != nil {
+		logrus.WithField("vol", vol).Error(err)
+	}
+	return data, err
+}
+
+// upgradeVolumeInfo writes back a record that was migrated when it was read,
+// for the migrate command, returning the store entry to compare-and-swap against from now on. If
+// another node changed the record in the meantime, it is left to them.
+func (d *seaweedfsDriver) upgradeVolumeInfo(pair *store.KVPair, vol seaweedfsVolume) (*store.KVPair, error) {
+	data, err := encodeVolumeInfo(vol)
+	if err != nil {
+		return pair, err
+	}
+
+	var newPair *store.KVPair
+	err = d.withStore(func(kv store.Store) (err error) {
+		_, newPair, err = kv.AtomicPut(pair.Key, data, pair, nil)
+		return err
+	})
+	if err != nil {
+		return pair, err
+	}
+	logrus.Infof("migrated volume %s to schema version %d", vol.Name, volumeSchemaVersion)
+	return newPair, nil
+}
+
+// migrateVolumes upgrades every volume record in the store to the current
+// schema version, returning how many needed it.
+func (d *seaweedfsDriver) migrateVolumes() (count int, err error) {
+	var entries []*store.KVPair
+	err = d.withStore(func(kv store.Store) (err error) {
+		entries, err = kv.List(keyPrefix, &store.ReadOptions{Consistent: true})
+		return err
+	})
+	if err == store.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, pair := range entries {
+		vol, migrated, err := decodeVolumeInfo(pair.Value)
+		if err == nil && migrated {
+			_, err = d.upgradeVolumeInfo(pair, vol)
+		}
+		if err != nil {
+			logrus.Errorf("migrating %s: %s", pair.Key, err)
+			failed++
+			continue
+		}
+		if migrated {
+			count++
+		}
+	}
+	if failed != 0 {
+		return count, fmt.Errorf("%d of %d volume records could not be migrated", failed, len(entries))
+	}
+	return count, nil
+}
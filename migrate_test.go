@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeVolumeInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   string
+		want     seaweedfsVolume
+		migrated bool
+	}{
+		{
+			name:   "unversioned",
+			record: `{"Name":"old","Mountpoint":"/mnt/docker-volumes/old","Options":["umask=775"]}`,
+			want: seaweedfsVolume{
+				SchemaVersion: len(migrations),
+				Name:          "old",
+				Mountpoint:    "/mnt/docker-volumes/old",
+				RemotePath:    "/mnt/docker-volumes/old",
+				Options:       []string{"mode=775"},
+				Filers:        []string{"filer:8888"},
+				Network:       "seaweedfs_internal",
+				Mounts:        map[string]string{},
+			},
+			migrated: true,
+		},
+		{
+			name: "version 2",
+			record: `{"SchemaVersion":2,"Name":"v2","Mountpoint":"/mnt/docker-volumes/v2","RemotePath":"/docker/volumes/v2",` +
+				`"Options":["uid=1000"],"Mounts":{"a":"node1"}}`,
+			want: seaweedfsVolume{
+				SchemaVersion: len(migrations),
+				Name:          "v2",
+				Mountpoint:    "/mnt/docker-volumes/v2",
+				RemotePath:    "/docker/volumes/v2",
+				Options:       []string{"uid=1000"},
+				Filers:        []string{"filer:8888"},
+				Network:       "seaweedfs_internal",
+				Mounts:        map[string]string{"a": "node1"},
+			},
+			migrated: true,
+		},
+		{
+			name: "current",
+			record: fmt.Sprintf(`{"SchemaVersion":%d,"Name":"new","Mountpoint":"/mnt/docker-volumes/new","RemotePath":"/data",`+
+				`"Options":["umask=022"],"Filers":["filer-b:8888"],"Network":"other","Mounts":{}}`, len(migrations)),
+			want: seaweedfsVolume{
+				SchemaVersion: len(migrations),
+				Name:          "new",
+				Mountpoint:    "/mnt/docker-volumes/new",
+				RemotePath:    "/data",
+				Options:       []string{"umask=022"},
+				Filers:        []string{"filer-b:8888"},
+				Network:       "other",
+				Mounts:        map[string]string{},
+			},
+		},
+	}
+	for _, test := range tests {
+		vol, migrated, err := decodeVolumeInfo([]byte(test.record))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if migrated != test.migrated {
+			t.Errorf("%s: migrated is %v, want %v", test.name, migrated, test.migrated)
+		}
+		if !reflect.DeepEqual(vol, test.want) {
+			t.Errorf("%s: decoded %+v, want %+v", test.name, vol, test.want)
+		}
+	}
+
+	newer := fmt.Sprintf(`{"SchemaVersion":%d,"Name":"newer"}`, len(migrations)+1)
+	if _, _, err := decodeVolumeInfo([]byte(newer)); err == nil {
+		t.Error("decoded a record of a newer schema version")
+	}
+}
+
+func TestMigrateVolumes(t *testing.T) {
+	d, _, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	d.kv.Put(keyPrefix+"old", []byte(`{"Name":"old","Mountpoint":"/mnt/docker-volumes/old"}`), nil)
+	d.kv.Put(keyPrefix+"older", []byte(`{"Name":"older","Mountpoint":"/mnt/docker-volumes/older"}`), nil)
+	current, err := d.kv.Get(keyPrefix+"test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := d.migrateVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("migrated %d records, want 2", count)
+	}
+	for _, name := range []string{"old", "older"} {
+		pair, err := d.kv.Get(keyPrefix+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, migrated, err := decodeVolumeInfo(pair.Value); err != nil || migrated {
+			t.Errorf("record %s was not written back at the current version: %s", name, pair.Value)
+		}
+	}
+	if pair, err := d.kv.Get(keyPrefix+"test", nil); err != nil || pair.LastIndex != current.LastIndex {
+		t.Errorf("the current record test was written back")
+	}
+
+	// nothing is left to migrate
+	if count, err := d.migrateVolumes(); err != nil || count != 0 {
+		t.Errorf("migrating again: %d records, %v", count, err)
+	}
+}
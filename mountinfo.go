@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+)
+
+// mountTimeout is how long Mount waits for weed mount to show up, set with MOUNT_TIMEOUT
+var mountTimeout time.Duration
+
+// mountPoll is how often the helper's mount table is checked meanwhile
+const mountPoll = 500 * time.Millisecond
+
+// fuseType is the file system type weed mount shows up as
+const fuseType = "fuse.seaweedfs"
+
+const mountInfoFile = "/proc/self/mountinfo"
+
+func checkMountTimeout() (err error) {
+	val := envOr("MOUNT_TIMEOUT", "30s")
+	if mountTimeout, err = time.ParseDuration(val); err != nil || mountTimeout <= 0 {
+		return fmt.Errorf("unsupported MOUNT_TIMEOUT %q, use a duration like 30s or 2m", val)
+	}
+	return nil
+}
+
+// mountInfo is the part of a mountinfo(5) line we look at
+type mountInfo struct {
+	mountpoint, fstype string
+}
+
+// parseMountInfo parses a mount table in the format of mountinfo(5).
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional fields...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		for i := 6; i < len(fields)-1; i++ {
+			if fields[i] == "-" {
+				mounts = append(mounts, mountInfo{
+					mountpoint: unescapeMountPath(fields[4]),
+					fstype:     fields[i+1],
+				})
+				break
+			}
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath undoes the octal escapes (\040 for a space) in mountinfo paths.
+func unescapeMountPath(p string) string {
+	if !strings.Contains(p, `\`) {
+		return p
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+4 <= len(p) {
+			if c, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// helperMounted tells whether the named helper container has weed mount
+// mounted at dir. It asks the helper, as the mount doesn't necessarily
+// propagate to the plugin, depending on how it was deployed.
+func helperMounted(ctx context.Context, cli *client.Client, containerName, dir string) (bool, error) {
+	out, err := execOutput(ctx, cli, containerName, []string{"cat", mountInfoFile})
+	if err != nil {
+		return false, err
+	}
+	mounts, err := parseMountInfo(strings.NewReader(out))
+	if err != nil {
+		return false, err
+	}
+	dir = filepath.Clean(dir)
+	for _, m := range mounts {
+		if m.mountpoint == dir && m.fstype == fuseType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitForMount waits for the helper container to mount dir, failing with the
+// helper's logs if it exits, or hasn't mounted within the mountTimeout.
+func waitForMount(dir, containerName string) error {
+	ctx := context.Background()
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(mountTimeout)
+	for {
+		mounted, err := helperMounted(ctx, cli, containerName, dir)
+		if err != nil {
+			logrus.Debugf("checking the mounts of %s: %s", containerName, err)
+		}
+		if mounted {
+			return nil
+		}
+
+		reason := ""
+		if container, err := cli.ContainerInspect(ctx, containerName); err != nil {
+			reason = err.Error()
+		} else if !container.State.Running {
+			reason = fmt.Sprintf("%s exited with status %d", containerName, container.State.ExitCode)
+		} else if time.Now().After(deadline) {
+			reason = fmt.Sprintf("not mounted after %s", mountTimeout)
+		}
+		if reason != "" {
+			logs, err := containerLogs(ctx, cli, containerName)
+			if err != nil {
+				logs = fmt.Sprintf("(no logs: %s)", err)
+			}
+			return fmt.Errorf("weed mount failed: %s, %s logs:\n%s", reason, containerName, logs)
+		}
+		time.Sleep(mountPoll)
+	}
+}
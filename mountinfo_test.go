@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	table := `22 1 0:21 / / rw,relatime - overlay overlay rw,lowerdir=/l,upperdir=/u,workdir=/w
+35 22 0:45 / /mnt/docker-volumes/test/_data rw,nosuid,nodev,relatime shared:20 - fuse.seaweedfs filer:8888:/docker/volumes/test rw,user_id=0,group_id=0,allow_other
+36 22 0:46 / /mnt/docker-volumes/with\040space/_data rw,relatime shared:21 master:3 - fuse.seaweedfs filer:8888:/x rw
+truncated line
+`
+	mounts, err := parseMountInfo(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mountInfo{
+		{mountpoint: "/", fstype: "overlay"},
+		{mountpoint: "/mnt/docker-volumes/test/_data", fstype: fuseType},
+		{mountpoint: "/mnt/docker-volumes/with space/_data", fstype: fuseType},
+	}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Errorf("parsed %+v, want %+v", mounts, want)
+	}
+}
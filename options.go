@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// optionKind is the type of value a volume option takes
+type optionKind int
+
+const (
+	optString optionKind = iota
+	optInt
+	optOctal
+	optBool
+	optID
+	optUser
+	optPath
+	optDuration
+)
+
+// optionSpec describes the values a volume option accepts
+type optionSpec struct {
+	kind optionKind
+	// range of optInt and optOctal values
+	min, max int64
+	// pattern an optString value has to match, if set
+	pattern *regexp.Regexp
+	// weedFlag options are passed through to `weed mount` as the flag of the same name
+	weedFlag bool
+}
+
+// maxID is the largest valid uid or gid, (uint32)-1 means "no change" to chown
+const maxID = 1<<32 - 2
+
+// nameRegexp matches user and group names, as useradd allows them by default
+var nameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*\$?$`)
+
+// optionSchema is every volume option docker volume create accepts. The
+// weedFlag ones are those `weed mount` has in the SEAWEEDFS_VERSION the
+// Dockerfile installs, 1.44.
+var optionSchema = map[string]optionSpec{
+	"uid":     {kind: optUser},
+	"gid":     {kind: optID},
+	"umask":   {kind: optOctal, min: 0, max: 0777, weedFlag: true},
+	"mode":    {kind: optOctal, min: 0, max: 0777},
+	"path":    {kind: optPath},
+	"filer":   {kind: optString, pattern: regexp.MustCompile(`^[^\s,]+:[0-9]+(,[^\s,]+:[0-9]+)*$`)},
+	"network": {kind: optString, pattern: regexp.MustCompile(`^\S+$`)},
+	"image":   {kind: optString, pattern: regexp.MustCompile(`^\S+$`)},
+	"linger":  {kind: optDuration},
+
+	"allowOthers":       {kind: optBool, weedFlag: true},
+	"chunkSizeLimitMB":  {kind: optInt, min: 1, max: 1024, weedFlag: true},
+	"collection":        {kind: optString, pattern: regexp.MustCompile(`^[A-Za-z0-9_-]+$`), weedFlag: true},
+	"dirListCacheLimit": {kind: optInt, min: 0, max: 1 << 24, weedFlag: true},
+	"replication":       {kind: optString, pattern: regexp.MustCompile(`^[0-9]{3}$`), weedFlag: true},
+	"ttl":               {kind: optInt, min: 0, max: 1<<31 - 1, weedFlag: true}, // in seconds
+}
+
+// supportedOptions returns the sorted names of all the volume options.
+func supportedOptions() []string {
+	var all []string
+	for key := range optionSchema {
+		all = append(all, key)
+	}
+	sort.Strings(all)
+	return all
+}
+
+// validateOption checks a volume option against the optionSchema.
+func validateOption(key, val string) error {
+	spec, ok := optionSchema[key]
+	if !ok {
+		return fmt.Errorf("unknown option %q, supported options are: %s", key, strings.Join(supportedOptions(), ", "))
+	}
+	if val == "" && spec.kind != optBool {
+		return fmt.Errorf("option %s needs a value", key)
+	}
+
+	switch spec.kind {
+	case optInt, optOctal:
+		base, what := 10, "an integer"
+		if spec.kind == optOctal {
+			base, what = 8, "an octal number"
+		}
+		n, err := strconv.ParseInt(val, base, 64)
+		if err != nil {
+			return fmt.Errorf("option %s=%s is not %s", key, val, what)
+		}
+		if n < spec.min || n > spec.max {
+			if spec.kind == optOctal {
+				return fmt.Errorf("option %s=%s is out of range %#o-%#o", key, val, spec.min, spec.max)
+			}
+			return fmt.Errorf("option %s=%s is out of range %d-%d", key, val, spec.min, spec.max)
+		}
+	case optBool:
+		if val == "" {
+			return nil
+		}
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("option %s=%s is not true or false", key, val)
+		}
+	case optID, optUser:
+		// a numeric ID or a name, users can also be given as user:group
+		ids := []string{val}
+		if spec.kind == optUser {
+			ids = strings.SplitN(val, ":", 2)
+		}
+		for _, id := range ids {
+			if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+				if n < 0 || n > maxID {
+					return fmt.Errorf("option %s=%s is out of range 0-%d", key, val, int64(maxID))
+				}
+			} else if !nameRegexp.MatchString(id) {
+				return fmt.Errorf("option %s=%s is neither a numeric ID nor a valid name", key, val)
+			}
+		}
+	case optPath:
+		if !path.IsAbs(val) {
+			return fmt.Errorf("option %s=%s is not an absolute path", key, val)
+		}
+	case optDuration:
+		if d, err := parseDuration(val); err != nil || d < 0 {
+			return fmt.Errorf("option %s=%s is not a duration like 90s or 5m", key, val)
+		}
+	case optString:
+		if spec.pattern != nil && !spec.pattern.MatchString(val) {
+			return fmt.Errorf("option %s=%s does not match %s", key, val, spec.pattern)
+		}
+	}
+	return nil
+}
+
+// parseDuration parses a duration like 90s or 5m, or a plain number of seconds.
+func parseDuration(val string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(val)
+}
+
+// optionValue returns the value of the key option, out of options stored as
+// key=value (or just key) strings.
+func optionValue(options []string, key string) (string, bool) {
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if parts[0] == key {
+			if len(parts) == 1 {
+				return "", true
+			}
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// weedMountArgs returns the `weed mount` flags for the passed through options,
+// which are stored as key=value (or just key) strings.
+func weedMountArgs(options []string) []string {
+	var args []string
+	for _, option := range options {
+		key := strings.SplitN(option, "=", 2)[0]
+		if optionSchema[key].weedFlag {
+			args = append(args, "-"+option)
+		}
+	}
+	return args
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateOption(t *testing.T) {
+	tests := []struct {
+		key, val string
+		// err is part of the expected error, empty if the option is valid
+		err string
+	}{
+		// unknown keys and empty values
+		{"nosuchoption", "1", "unknown option"},
+		{"cacheCapacityMB", "500", "unknown option"},
+		{"uid", "", "needs a value"},
+		{"ttl", "", "needs a value"},
+		{"collection", "", "needs a value"},
+		{"allowOthers", "", ""},
+
+		// integers and their range
+		{"chunkSizeLimitMB", "4", ""},
+		{"chunkSizeLimitMB", "1024", ""},
+		{"chunkSizeLimitMB", "0", "out of range 1-1024"},
+		{"chunkSizeLimitMB", "1025", "out of range"},
+		{"chunkSizeLimitMB", "4MB", "not an integer"},
+		{"dirListCacheLimit", "-1", "out of range"},
+		{"ttl", "604800", ""},
+		{"ttl", "7d", "not an integer"},
+
+		// octal numbers
+		{"umask", "022", ""},
+		{"umask", "0777", ""},
+		{"mode", "755", ""},
+		{"umask", "0778", "not an octal number"},
+		{"mode", "1777", "out of range 0-0777"},
+
+		// booleans
+		{"allowOthers", "false", ""},
+		{"allowOthers", "yes", "not true or false"},
+
+		// users, groups and user:group
+		{"uid", "1000", ""},
+		{"uid", "www-data", ""},
+		{"uid", "1000:1000", ""},
+		{"uid", "www-data:www-data", ""},
+		{"uid", "-1", "out of range"},
+		{"uid", "4294967295", "out of range"},
+		{"uid", "1000:Bad Group", "neither a numeric ID nor a valid name"},
+		{"gid", "100", ""},
+		{"gid", "users", ""},
+		{"gid", "1000:1000", "neither a numeric ID nor a valid name"},
+
+		// paths, durations and patterns
+		{"path", "/datasets/imagenet", ""},
+		{"path", "datasets", "not an absolute path"},
+		{"linger", "10m", ""},
+		{"linger", "90", ""},
+		{"linger", "-1s", "not a duration"},
+		{"linger", "soon", "not a duration"},
+		{"filer", "filer-b1:8888,filer-b2:8888", ""},
+		{"filer", "filer-b1", "does not match"},
+		{"replication", "001", ""},
+		{"replication", "01", "does not match"},
+		{"collection", "my builds", "does not match"},
+	}
+	for _, test := range tests {
+		err := validateOption(test.key, test.val)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s=%s: %s", test.key, test.val, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s=%s: no error, want one with %q", test.key, test.val, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s=%s: %s, want an error with %q", test.key, test.val, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// reconciledPrefix starts the mount IDs reconcileMounts makes up for the
+// containers that mounted a volume before the plugin restarted
+const reconciledPrefix = "reconciled-"
+
+// reconcileMounts corrects the number of mounts the store has for this node to
+// the number of running containers using each volume, after the plugin or
+// dockerd restarted. Mount and Unmount wait for it to be done, so that none
+// on this node comes in between.
+func (d *seaweedfsDriver) reconcileMounts() error {
+	ctx := context.Background()
+	node, err := getNodeName()
+	if err != nil {
+		return fmt.Errorf("cannot determine node name: %s", err)
+	}
+	users, err := volumeUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("listing containers: %s", err)
+	}
+	vols, err := d.listVolumeInfo()
+	if err != nil {
+		return fmt.Errorf("listing volumes: %s", err)
+	}
+
+	for _, v := range vols {
+		containers := users[v.Name]
+		if n := v.nodeMounts(node); n != len(containers) {
+			logrus.Infof("volume %s has %d mount(s) on this node, but is used by %d container(s)", v.Name, n, len(containers))
+			if _, err := d.modifyVolumeInfo(v.Name, func(v *seaweedfsVolume) error {
+				resetNodeMounts(v, node, containers)
+				return nil
+			}); err != nil {
+				logrus.Errorf("reconciling volume %s: %s", v.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// waitReconciled waits for reconcileMounts to be done, if the plugin runs it.
+func (d *seaweedfsDriver) waitReconciled() {
+	if d.reconciled != nil {
+		<-d.reconciled
+	}
+}
+
+// isPluginDriver tells whether driver, as Docker lists it for a volume, is this
+// plugin. Docker adds the :latest tag to managed plugins installed without one.
+func isPluginDriver(driver string) bool {
+	return strings.TrimSuffix(driver, ":latest") == strings.TrimSuffix(pluginName, ":latest")
+}
+
+// volumeUsers returns the IDs of the running containers on this node, by the
+// name of the plugin's volumes they have mounted.
+func volumeUsers(ctx context.Context) (map[string][]string, error) {
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	users := map[string][]string{}
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Type == mount.TypeVolume && isPluginDriver(m.Driver) {
+				users[m.Name] = append(users[m.Name], c.ID)
+			}
+		}
+	}
+	return users, nil
+}
+
+// resetNodeMounts replaces the volume's mount IDs for this node with one for
+// each of the containers using it. Docker's mount IDs can't be matched to
+// containers, so they are made up, and Unmount drops one of them for each ID
+// it doesn't know.
+func resetNodeMounts(v *seaweedfsVolume, node string, containers []string) {
+	if v.Mounts == nil {
+		v.Mounts = map[string]string{}
+	}
+	for id, n := range v.Mounts {
+		if n == node {
+			delete(v.Mounts, id)
+		}
+	}
+	for _, id := range containers {
+		v.Mounts[reconciledPrefix+id] = node
+	}
+}
+
+// reconciledMount returns one of the mount IDs resetNodeMounts made up for
+// this node, or "" if there are none left.
+func reconciledMount(v *seaweedfsVolume, node string) string {
+	var ids []string
+	for id, n := range v.Mounts {
+		if n == node && strings.HasPrefix(id, reconciledPrefix) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Strings(ids)
+	return ids[0]
+}
+
+// reconcileHelpers brings this node's mount helpers in line with the store,
+// once reconcileMounts corrected it: volumes that running containers use are
+// mounted again if their mount is gone, those no container uses are
+// unmounted, and outdated helpers no container uses are removed. The plugin
+// is serving requests by then, so each volume is looked at under its lock.
+func (d *seaweedfsDriver) reconcileHelpers() error {
+	node, err := getNodeName()
+	if err != nil {
+		return fmt.Errorf("cannot determine node name: %s", err)
+	}
+	vols, err := d.listVolumeInfo()
+	if err != nil {
+		return fmt.Errorf("listing volumes: %s", err)
+	}
+	for _, v := range vols {
+		if err := d.reconcileHelper(v.Name, node); err != nil {
+			logrus.Errorf("reconciling volume %s: %s", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// reconcileHelper reconciles the named volume's helper on this node. Whether
+// the volume is mounted is asked of the helper itself, and if it can't tell,
+// the helper is left alone.
+func (d *seaweedfsDriver) reconcileHelper(name, node string) error {
+	unlock, err := d.lockVolume(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	v, err := d.getVolumeInfo(name)
+	if err == store.ErrKeyNotFound {
+		// removed in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return err
+	}
+	containerName := v.containerName()
+	exists, running, mounted := false, false, false
+	c, err := cli.ContainerInspect(ctx, containerName)
+	if err == nil {
+		exists, running = true, c.State.Running
+	} else if !client.IsErrNotFound(err) {
+		return err
+	}
+	if running {
+		if mounted, err = helperMounted(ctx, cli, containerName, filepath.Join(v.Mountpoint, "_data")); err != nil {
+			return fmt.Errorf("checking the mounts of %s: %s", containerName, err)
+		}
+	}
+
+	n := v.nodeMounts(node)
+	if exists {
+		outdated, err := helperOutdated(c.Config.Labels, &v)
+		if err != nil {
+			return err
+		}
+		if outdated && n == 0 {
+			logrus.Infof("removing outdated helper container %s of volume %s", containerName, name)
+			return stopAndRemoveContainer(ctx, containerName)
+		}
+		if outdated {
+			logrus.Warnf("helper container %s of volume %s is outdated, but used by %d container(s), it is recreated once they are gone", containerName, name, n)
+		}
+	}
+
+	switch {
+	case n != 0 && !mounted:
+		logrus.Infof("remounting volume %s, used by %d container(s) on this node", name, n)
+		if running {
+			// running, but it has nothing mounted: weed mount is stuck
+			if err := stopAndRemoveContainer(ctx, containerName); err != nil {
+				return err
+			}
+		}
+		return d.helpers.mount(&v)
+	case n == 0 && mounted:
+		return d.scheduleUnmount(&v)
+	case n == 0 && running:
+		return d.helpers.unmount(&v)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestResetNodeMounts(t *testing.T) {
+	v := seaweedfsVolume{Mounts: map[string]string{"stale": "node1", "other": "node2"}}
+	resetNodeMounts(&v, "node1", []string{"c1", "c2"})
+
+	want := map[string]string{"reconciled-c1": "node1", "reconciled-c2": "node1", "other": "node2"}
+	if len(v.Mounts) != len(want) {
+		t.Errorf("mounts %v, want %v", v.Mounts, want)
+	}
+	for id, node := range want {
+		if v.Mounts[id] != node {
+			t.Errorf("mounts %v, want %v", v.Mounts, want)
+			break
+		}
+	}
+}
+
+func TestUnmountDropsReconciledMounts(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// two containers mounted it before the plugin restarted
+	if _, err := d.modifyVolumeInfo("test", func(v *seaweedfsVolume) error {
+		resetNodeMounts(v, "node1", []string{"c1", "c2"})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// their mount IDs are unknown, each stands for one of the made up ones
+	for i, id := range []string{"unknown1", "new", "unknown2"} {
+		if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if n, want := nodeMounts(t, d, "node1"), 2-i; n != want {
+			t.Errorf("%d mounts after unmounting %s, want %d", n, id, want)
+		}
+	}
+	checkCounts(t, h, 0, 1, 0)
+
+	// once they are gone, unknown IDs change nothing
+	if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: "unknown3"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := nodeMounts(t, d, "node1"); n != 0 {
+		t.Errorf("%d mounts after unmounting an unknown ID, want 0", n)
+	}
+}
+
+func TestMountWaitsForReconcile(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+	d.reconciled = make(chan struct{})
+
+	done := make(chan error)
+	go func() {
+		_, err := d.Mount(&volume.MountRequest{Name: "test", ID: "a"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Mount returned before reconciling: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(d.reconciled)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, h, 1, 0, 0)
+}
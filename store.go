@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/abronan/valkeyrie"
+	"github.com/abronan/valkeyrie/store"
+	"github.com/abronan/valkeyrie/store/boltdb"
+	"github.com/abronan/valkeyrie/store/consul"
+	etcd "github.com/abronan/valkeyrie/store/etcd/v2"
+	etcdv3 "github.com/abronan/valkeyrie/store/etcd/v3"
+	"github.com/abronan/valkeyrie/store/zookeeper"
+)
+
+// Metadata store settings, see the STORE_* env settings in config.json
+var (
+	// valkeyrie backend name: etcd, etcdv3, consul, zk, boltdb or local
+	storeBackend = envOr("STORE_BACKEND", string(store.ETCD))
+	// comma separated list of store endpoints
+	storeEndpoints = splitList(envOr("STORE_ENDPOINTS", "etcd:2379"))
+	// prefix for volume info
+	keyPrefix = strings.TrimSuffix(envOr("STORE_PREFIX", "/docker-seaweedfs-plugin"), "/") + "/"
+)
+
+// bucket used by the boltdb backend, ignored by the others
+const storeBucket = "docker-seaweedfs-plugin"
+
+// storeLocal is a single node store mode that keeps the volume records in a BoltDB
+// file on the plugin's state mount, so no etcd is needed.
+const storeLocal = "local"
+
+// localStoreFile is the BoltDB file used by the local store mode
+var localStoreFile = filepath.Join(stateDir, "volumes.db")
+
+// how often, and how patiently, to retry a store request that failed to reach the store
+const (
+	storeAttempts = 5
+	storeBackoff  = 500 * time.Millisecond
+)
+
+// how often to retry a compare-and-swap of a volume record that another node
+// changed in between, waiting up to casBackoff (randomised) between attempts
+const (
+	casAttempts = 10
+	casBackoff  = 100 * time.Millisecond
+)
+
+// after breakerThreshold consecutive failed requests the store is considered
+// down, and requests fail straight away for breakerCooldown
+const (
+	breakerThreshold = 3
+	breakerCooldown  = 30 * time.Second
+)
+
+// initStore checks the store settings and registers the valkeyrie backends.
+func initStore() error {
+	switch store.Backend(storeBackend) {
+	case store.ETCD, store.ETCDV3, store.CONSUL, store.ZK, store.BOLTDB:
+	case storeLocal:
+		storeEndpoints = []string{localStoreFile}
+		if err := os.MkdirAll(filepath.Dir(localStoreFile), 0700); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported STORE_BACKEND %q", storeBackend)
+	}
+	if len(storeEndpoints) == 0 {
+		return fmt.Errorf("no STORE_ENDPOINTS set for %s", storeBackend)
+	}
+
+	etcd.Register()
+	etcdv3.Register()
+	consul.Register()
+	zookeeper.Register()
+	boltdb.Register()
+
+	return nil
+}
+
+// isLocalStore reports whether the volume records only live on this node.
+func isLocalStore() bool {
+	return storeBackend == storeLocal || store.Backend(storeBackend) == store.BOLTDB
+}
+
+func newStore() (store.Store, error) {
+	backend := store.Backend(storeBackend)
+	if storeBackend == storeLocal {
+		backend = store.BOLTDB
+	}
+	return valkeyrie.NewStore(
+		backend,
+		storeEndpoints,
+		&store.Config{
+			ConnectionTimeout: 5 * time.Second,
+			Bucket:            storeBucket,
+			PersistConnection: storeBackend == storeLocal,
+		},
+	)
+}
+
+// getStore returns the store client shared by all requests, connecting it
+// if there is none.
+func (d *seaweedfsDriver) getStore() (store.Store, error) {
+	d.kvLock.Lock()
+	defer d.kvLock.Unlock()
+
+	if d.kv != nil {
+		return d.kv, nil
+	}
+
+	kv, err := newStore()
+	if err != nil {
+		return nil, err
+	}
+	d.kv = kv
+	return d.kv, nil
+}
+
+// isStoreFailure reports whether err means the store could not be reached,
+// rather than a missing or changed key.
+func isStoreFailure(err error) bool {
+	switch err {
+	case nil, store.ErrKeyNotFound, store.ErrKeyModified, store.ErrKeyExists, store.ErrCallNotSupported:
+		return false
+	}
+	return true
+}
+
+// checkStore drops the shared client if err means the store could not be
+// reached, so the next request reconnects.
+func (d *seaweedfsDriver) checkStore(kv store.Store, err error) {
+	if !isStoreFailure(err) {
+		return
+	}
+
+	d.kvLock.Lock()
+	defer d.kvLock.Unlock()
+	if d.kv == kv {
+		logrus.Warnf("dropping store connection: %s", err)
+		d.kv.Close()
+		d.kv = nil
+	}
+}
+
+// withStore runs fn against the shared store client, retrying with an exponential
+// backoff while the store cannot be reached (eg. during an etcd leader election).
+func (d *seaweedfsDriver) withStore(fn func(kv store.Store) error) error {
+	if err := d.breaker.allow(); err != nil {
+		return err
+	}
+
+	var err error
+	backoff := storeBackoff
+	for attempt := 1; attempt <= storeAttempts; attempt++ {
+		var kv store.Store
+		if kv, err = d.getStore(); err == nil {
+			err = fn(kv)
+			d.checkStore(kv, err)
+		}
+		if !isStoreFailure(err) {
+			d.breaker.success()
+			return err
+		}
+		logrus.Warnf("store %s at %v (attempt %d): %s", storeBackend, storeEndpoints, attempt, err)
+		if attempt < storeAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	d.breaker.failure()
+	return fmt.Errorf("metadata store %s unavailable: %s", storeBackend, err)
+}
+
+// circuitBreaker makes requests fail fast while the store is known to be down,
+// instead of each of them waiting through all the retries.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if time.Now().Before(b.openUntil) {
+		return fmt.Errorf("metadata store %s unavailable, retrying after %s", storeBackend, b.openUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (b *circuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// once open, a single failed request after the cooldown opens it again
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// getVolumePair returns the named volume's record, along with the store
+// entry needed to compare-and-swap it.
+func (d *seaweedfsDriver) getVolumePair(name string) (pair *store.KVPair, vol seaweedfsVolume, err error) {
+	err = d.withStore(func(kv store.Store) (err error) {
+		pair, err = kv.Get(keyPrefix+name, &store.ReadOptions{Consistent: true})
+		return err
+	})
+	if err != nil {
+		logrus.Debugf("Error trying accessing value at key %v: %s", name, err)
+		return nil, vol, err
+	}
+
+	// older records are migrated in memory only, they are written back once
+	// the volume is changed, or by the migrate command
+	vol, _, err = decodeVolumeInfo(pair.Value)
+	if err != nil {
+		return nil, vol, fmt.Errorf("decoding %s: %s", pair.Key, err)
+	}
+	return pair, vol, nil
+}
+
+func (d *seaweedfsDriver) getVolumeInfo(name string) (vol seaweedfsVolume, err error) {
+	_, vol, err = d.getVolumePair(name)
+	return vol, err
+}
+
+// createVolumeInfo stores the record of a new volume. If the volume already
+// exists (eg. it was created from another node) the existing record is kept.
+func (d *seaweedfsDriver) createVolumeInfo(vol seaweedfsVolume) error {
+	data, err := encodeVolumeInfo(vol)
+	if err != nil {
+		return err
+	}
+
+	err = d.withStore(func(kv store.Store) error {
+		_, _, err := kv.AtomicPut(keyPrefix+vol.Name, data, nil, nil)
+		return err
+	})
+	if err == store.ErrKeyExists {
+		logrus.Debugf("volume %s already exists", vol.Name)
+		return nil
+	}
+	if err != nil {
+		logrus.Debugf("Error trying to put value at key %v: %s", vol.Name, err)
+	}
+
+	return err
+}
+
+// modifyVolumeInfo applies fn to the named volume's record and writes it back
+// with a compare-and-swap, re-reading the record and applying fn again if
+// another node changed it in between.
+func (d *seaweedfsDriver) modifyVolumeInfo(name string, fn func(vol *seaweedfsVolume) error) (vol seaweedfsVolume, err error) {
+	for attempt := 1; ; attempt++ {
+		var pair *store.KVPair
+		if pair, vol, err = d.getVolumePair(name); err != nil {
+			return vol, err
+		}
+		if err = fn(&vol); err != nil {
+			return vol, err
+		}
+		data, err := encodeVolumeInfo(vol)
+		if err != nil {
+			return vol, err
+		}
+
+		err = d.withStore(func(kv store.Store) error {
+			_, _, err := kv.AtomicPut(keyPrefix+name, data, pair, nil)
+			return err
+		})
+		if err != store.ErrKeyModified || attempt == casAttempts {
+			return vol, err
+		}
+		logrus.Debugf("volume %s was changed concurrently, retrying (attempt %d)", name, attempt)
+		time.Sleep(time.Duration(rand.Int63n(int64(casBackoff))))
+	}
+}
+
+// removeVolumeInfo deletes the named volume's record, provided check still
+// accepts the current record.
+func (d *seaweedfsDriver) removeVolumeInfo(name string, check func(vol *seaweedfsVolume) error) error {
+	for attempt := 1; ; attempt++ {
+		pair, vol, err := d.getVolumePair(name)
+		if err != nil {
+			return err
+		}
+		if err = check(&vol); err != nil {
+			return err
+		}
+
+		err = d.withStore(func(kv store.Store) error {
+			_, err := kv.AtomicDelete(keyPrefix+name, pair)
+			return err
+		})
+		if err != store.ErrKeyModified || attempt == casAttempts {
+			return err
+		}
+		logrus.Debugf("volume %s was changed concurrently, retrying (attempt %d)", name, attempt)
+		time.Sleep(time.Duration(rand.Int63n(int64(casBackoff))))
+	}
+}
+
+// listVolumeInfo returns all the volume records in the store, leaving out
+// those that can't be decoded.
+func (d *seaweedfsDriver) listVolumeInfo() ([]seaweedfsVolume, error) {
+	var entries []*store.KVPair
+	err := d.withStore(func(kv store.Store) (err error) {
+		entries, err = kv.List(keyPrefix, &store.ReadOptions{Consistent: true})
+		return err
+	})
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vols := make([]seaweedfsVolume, 0, len(entries))
+	for _, pair := range entries {
+		v, _, err := decodeVolumeInfo(pair.Value)
+		if err != nil {
+			logrus.Warnf("skipping %s: %s", pair.Key, err)
+			continue
+		}
+		vols = append(vols, v)
+	}
+	return vols, nil
+}
+
+// checkUnused refuses volumes that still have mounts recorded on any node.
+func checkUnused(vol *seaweedfsVolume) error {
+	if len(vol.Mounts) != 0 {
+		return fmt.Errorf("currently used by %d container(s)", len(vol.Mounts))
+	}
+	return nil
+}
+
+// volumeError turns an error looking up the named volume into the error returned to Docker.
+func volumeError(name string, err error) error {
+	if err == store.ErrKeyNotFound {
+		return logError("volume %s not found", name)
+	}
+	return logError("volume %s: %s", name, err)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// memStore is an in-memory store.Store. Like boltdb, it does not support
+// locks or watches.
+type memStore struct {
+	lock  sync.Mutex
+	index uint64
+	kv    map[string]*store.KVPair
+}
+
+func newMemStore() *memStore {
+	return &memStore{kv: map[string]*store.KVPair{}}
+}
+
+// put stores a copy of value at key, the caller holds the lock.
+func (s *memStore) put(key string, value []byte) *store.KVPair {
+	s.index++
+	pair := &store.KVPair{Key: key, Value: append([]byte(nil), value...), LastIndex: s.index}
+	s.kv[key] = pair
+	return copyPair(pair)
+}
+
+func copyPair(pair *store.KVPair) *store.KVPair {
+	return &store.KVPair{Key: pair.Key, Value: append([]byte(nil), pair.Value...), LastIndex: pair.LastIndex}
+}
+
+func (s *memStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(key, value)
+	return nil
+}
+
+func (s *memStore) Get(key string, options *store.ReadOptions) (*store.KVPair, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pair, ok := s.kv[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return copyPair(pair), nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.kv[key]; !ok {
+		return store.ErrKeyNotFound
+	}
+	delete(s.kv, key)
+	return nil
+}
+
+func (s *memStore) Exists(key string, options *store.ReadOptions) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.kv[key]
+	return ok, nil
+}
+
+func (s *memStore) Watch(key string, stopCh <-chan struct{}, options *store.ReadOptions) (<-chan *store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (s *memStore) WatchTree(directory string, stopCh <-chan struct{}, options *store.ReadOptions) (<-chan []*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (s *memStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (s *memStore) List(directory string, options *store.ReadOptions) ([]*store.KVPair, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var keys []string
+	for key := range s.kv {
+		if strings.HasPrefix(key, directory) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	sort.Strings(keys)
+	pairs := make([]*store.KVPair, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, copyPair(s.kv[key]))
+	}
+	return pairs, nil
+}
+
+func (s *memStore) DeleteTree(directory string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.kv {
+		if strings.HasPrefix(key, directory) {
+			delete(s.kv, key)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, ok := s.kv[key]
+	switch {
+	case previous == nil && ok:
+		return false, nil, store.ErrKeyExists
+	case previous != nil && !ok:
+		return false, nil, store.ErrKeyNotFound
+	case previous != nil && current.LastIndex != previous.LastIndex:
+		return false, nil, store.ErrKeyModified
+	}
+	return true, s.put(key, value), nil
+}
+
+func (s *memStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, ok := s.kv[key]
+	switch {
+	case !ok:
+		return false, store.ErrKeyNotFound
+	case previous != nil && current.LastIndex != previous.LastIndex:
+		return false, store.ErrKeyModified
+	}
+	delete(s.kv, key)
+	return true, nil
+}
+
+func (s *memStore) Close() {}
+
+func TestModifyVolumeInfoConcurrently(t *testing.T) {
+	d, _, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// no more writers than casAttempts, each of them can only lose to all the others once
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, err := d.modifyVolumeInfo("test", func(v *seaweedfsVolume) error {
+				if v.Mounts == nil {
+					v.Mounts = map[string]string{}
+				}
+				v.Mounts[id] = "node1"
+				return nil
+			})
+			errs <- err
+		}(fmt.Sprintf("mount-%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := nodeMounts(t, d, "node1"); n != writers {
+		t.Errorf("%d mounts recorded by %d concurrent writers", n, writers)
+	}
+}
+
+func TestParallelMounts(t *testing.T) {
+	d, h, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	const containers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < containers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := d.Mount(&volume.MountRequest{Name: "test", ID: id}); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("container-%d", i))
+	}
+	wg.Wait()
+	checkCounts(t, h, 1, 0, 0)
+	if n := nodeMounts(t, d, "node1"); n != containers {
+		t.Errorf("%d mounts recorded for %d containers", n, containers)
+	}
+
+	for i := 0; i < containers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := d.Unmount(&volume.UnmountRequest{Name: "test", ID: id}); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("container-%d", i))
+	}
+	wg.Wait()
+	checkCounts(t, h, 1, 1, 0)
+	if n := nodeMounts(t, d, "node1"); n != 0 {
+		t.Errorf("%d mounts left after unmounting all", n)
+	}
+}
+
+func TestReadsDoNotWriteBack(t *testing.T) {
+	d, _, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	old := []byte(`{"Name":"old","Mountpoint":"/mnt/docker-volumes/old"}`)
+	d.kv.Put(keyPrefix+"old", old, nil)
+	d.kv.Put(keyPrefix+"broken", []byte(`{"SchemaVersion":1000}`), nil)
+
+	if _, err := d.getVolumeInfo("old"); err != nil {
+		t.Fatal(err)
+	}
+	vols, err := d.listVolumeInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range vols {
+		names = append(names, v.Name)
+	}
+	if strings.Join(names, ",") != "old,test" {
+		t.Errorf("listed volumes %v, want [old test]", names)
+	}
+
+	pair, err := d.kv.Get(keyPrefix+"old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pair.Value) != string(old) {
+		t.Errorf("reading an old record wrote it back as %s", pair.Value)
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/cli/cli/connhelper"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/sirupsen/logrus"
 	// TODO: beware, this is archived
 )
@@ -16,6 +23,25 @@ import (
 // Worth reading: https://docs.docker.com/engine/api/v1.24/
 // and https://docs.docker.com/engine/api/v1.27/#operation/ContainerCreate
 
+// envOr returns the value of the plugin setting name, or def if it is empty.
+func envOr(name, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+// splitList splits a comma separated setting, dropping empty entries.
+func splitList(val string) []string {
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func GetDockerClient(ctx context.Context, host string) (*client.Client, error) {
 	// TODO: the docker-ce ssh helper requires code in the docker daemon 18.09
 	//       change this to use pure ssh tunneled unix sockets so it can be any version
@@ -46,6 +72,241 @@ func GetDockerClient(ctx context.Context, host string) (*client.Client, error) {
 	return cli, err
 }
 
+// checkNetwork checks that the named Docker network exists.
+func checkNetwork(name string) error {
+	if name == "" {
+		return fmt.Errorf("no network set")
+	}
+	ctx := context.Background()
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return err
+	}
+	if _, err := cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{}); err != nil {
+		return fmt.Errorf("network %s: %s", name, err)
+	}
+	return nil
+}
+
+// imageDigest returns the digest of the image the named container runs, or if
+// there is no such container, of the named image.
+func imageDigest(containerName, image string) (string, error) {
+	ctx := context.Background()
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	if container, err := cli.ContainerInspect(ctx, containerName); err == nil {
+		image = container.Image
+	}
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return "", fmt.Errorf("%s not pulled", image)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(inspect.RepoDigests) != 0 {
+		return inspect.RepoDigests[0], nil
+	}
+	return inspect.ID, nil
+}
+
+// nodeName caches getNodeName, requests ask for it concurrently
+var (
+	nodeNameLock sync.Mutex
+	nodeName     = ""
+)
+
+// getNodeName returns the swarm node ID of the Docker engine the plugin talks to,
+// or its hostname if it is not part of a swarm.
+func getNodeName() (string, error) {
+	nodeNameLock.Lock()
+	defer nodeNameLock.Unlock()
+
+	if nodeName != "" {
+		return nodeName, nil
+	}
+	ctx := context.Background()
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	nodeName = info.Swarm.NodeID
+	if nodeName == "" {
+		nodeName = info.Name
+	}
+	return nodeName, nil
+}
+
+// pullPolicy decides when images are pulled: always, if-not-present or never
+var pullPolicy = envOr("PULL_POLICY", pullIfNotPresent)
+
+const (
+	pullAlways       = "always"
+	pullIfNotPresent = "if-not-present"
+	pullNever        = "never"
+)
+
+func checkPullPolicy() error {
+	switch pullPolicy {
+	case pullAlways, pullIfNotPresent, pullNever:
+		return nil
+	}
+	return fmt.Errorf("unsupported PULL_POLICY %q, use %s, %s or %s", pullPolicy, pullAlways, pullIfNotPresent, pullNever)
+}
+
+// ensureImage makes sure image is present on this node, pulling it as the pullPolicy says.
+func ensureImage(ctx context.Context, cli *client.Client, image string) error {
+	if pullPolicy != pullAlways {
+		_, _, err := cli.ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return logError("Error inspecting image %s: %s", image, err)
+		}
+		if pullPolicy == pullNever {
+			return logError("image %s is not present on this node, and PULL_POLICY is %s", image, pullPolicy)
+		}
+	}
+
+	reader, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		logError("Error pulling Container: %s", err)
+		return err
+	}
+	defer reader.Close()
+	//io.Copy(os.Stdout, reader)
+	b, err := ioutil.ReadAll(reader)
+	logrus.Debugf("ImagePull(%s): (Err: %s ) Output: %s", image, err, b)
+	if err != nil {
+		logError("ImagePull: %s", err)
+		return err
+	}
+	return nil
+}
+
+// helperLogLines is how much of a failed helper container's log is reported
+const helperLogLines = "50"
+
+// containerLogs returns the tail of the named container's stdout and stderr.
+func containerLogs(ctx context.Context, cli *client.Client, containerName string) (string, error) {
+	reader, err := cli.ContainerLogs(ctx, containerName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       helperLogLines,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	// the helper has no tty, so its log is multiplexed
+	var logs bytes.Buffer
+	if _, err := stdcopy.StdCopy(&logs, &logs, reader); err != nil {
+		return logs.String(), err
+	}
+	return logs.String(), nil
+}
+
+// execTimeout bounds execOutput, so a hung mount can't block it
+const execTimeout = 5 * time.Second
+
+// execOutput runs cmd as root in the named running container, and returns its
+// stdout, or an error if it exits with another status than 0.
+func execOutput(ctx context.Context, cli *client.Client, containerName string, cmd []string) (string, error) {
+	execID, err := cli.ContainerExecCreate(ctx, containerName, types.ExecConfig{
+		User:         "0",
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := cli.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+	resp.Conn.SetDeadline(time.Now().Add(execTimeout))
+
+	var out, errOut bytes.Buffer
+	if _, err := stdcopy.StdCopy(&out, &errOut, resp.Reader); err != nil {
+		return "", err
+	}
+	inspect, err := cli.ContainerExecInspect(ctx, execID.ID)
+	if err != nil {
+		return "", err
+	}
+	if inspect.ExitCode != 0 {
+		return "", fmt.Errorf("%s exited with status %d: %s", strings.Join(cmd, " "), inspect.ExitCode, strings.TrimSpace(errOut.String()))
+	}
+	return out.String(), nil
+}
+
+// runOnce runs cmd in a throwaway container of image attached to the named
+// network, returning its exit status and output once it is done.
+func runOnce(ctx context.Context, image, networkName string, cmd []string) (status int64, stdout, stderr string, err error) {
+	cli, err := GetDockerClient(ctx, "")
+	if err != nil {
+		return 0, "", "", err
+	}
+	if err := ensureImage(ctx, cli, image); err != nil {
+		return 0, "", "", err
+	}
+
+	created, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			Image:      image,
+			Entrypoint: cmd,
+			Labels:     pluginLabels(""),
+		},
+		&container.HostConfig{},
+		&network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				networkName: {},
+			},
+		},
+		"",
+	)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer func() {
+		if err := removeContainer(context.Background(), created.ID); err != nil {
+			logrus.Warnf("removing container %s: %s", created.ID, err)
+		}
+	}()
+
+	if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return 0, "", "", err
+	}
+	waitC, errC := cli.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case res := <-waitC:
+		status = res.StatusCode
+	case err := <-errC:
+		return 0, "", "", err
+	}
+
+	reader, err := cli.ContainerLogs(ctx, created.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return status, "", "", err
+	}
+	defer reader.Close()
+	var out, errOut bytes.Buffer
+	_, err = stdcopy.StdCopy(&out, &errOut, reader)
+	return status, out.String(), errOut.String(), err
+}
+
 func runContainer(
 	config *container.Config,
 	hostConfig *container.HostConfig,
@@ -59,33 +320,35 @@ func runContainer(
 		return "", err
 	}
 
+	hash, err := configHash(config, hostConfig, networkingConfig)
+	if err != nil {
+		return "", err
+	}
+	labels := map[string]string{labelConfig: hash}
+	for key, val := range config.Labels {
+		labels[key] = val
+	}
+	labeled := *config
+	labeled.Labels = labels
+	config = &labeled
+
 	if container, err := cli.ContainerInspect(ctx, containerName); err == nil {
-		if container.State.Running {
+		if container.Config.Labels[labelConfig] == hash {
+			if container.State.Running {
+				return container.ID, nil
+			}
+			if err := cli.ContainerStart(ctx, container.ID, types.ContainerStartOptions{}); err != nil {
+				return "", err
+			}
 			return container.ID, nil
 		}
-		// if err := cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{
-		// 	RemoveVolumes: true,
-		// 	RemoveLinks:   true,
-		// 	Force:         true,
-		// }); err != nil {
-		// 	return "", err
-		// }
-		if err := cli.ContainerStart(ctx, container.ID, types.ContainerStartOptions{}); err != nil {
-			return "", err
+		logrus.Infof("recreating %s, it was created from a different configuration", containerName)
+		if err := stopAndRemoveContainer(ctx, container.ID); err != nil {
+			return "", logError("Error removing Container %s: %s", containerName, err)
 		}
-		return container.ID, nil
 	}
 
-	reader, err := cli.ImagePull(ctx, config.Image, types.ImagePullOptions{})
-	if err != nil {
-		logError("Error pulling Container: %s", err)
-		return "", err
-	}
-	//io.Copy(os.Stdout, reader)
-	b, err := ioutil.ReadAll(reader)
-	logrus.Debugf("ImagePull(%s): (Err: %s ) Output: %s", config.Image, err, b)
-	if err != nil {
-		logError("ImagePull: %s", err)
+	if err := ensureImage(ctx, cli, config.Image); err != nil {
 		return "", err
 	}
 